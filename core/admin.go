@@ -0,0 +1,395 @@
+// Copyright (c) 2016 shawn1m. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package core
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/shawn1m/overture/core/errors"
+)
+
+// ruleList is a block, hosts or replace list which can be edited at runtime by the admin API. The list
+// is kept as lines of its file, it is rebuilt and replaced as a whole after every edit, and written back
+// to its file if AdminPersist is set. A subscribed list is never written back, its file is the copy of
+// the subscription, which is replaced by the next download.
+type ruleList struct {
+	file string
+	// Lines of the file, nil until the list is used by the admin API for the first time
+	lines []string
+	// parse returns the line of the entry in query and a function matching lines of the same entry.
+	// Removing an entry only needs the parameters of the match function.
+	parse func(query url.Values, isRemove bool) (line string, match func(fields []string) bool, err error)
+	apply func(lines []string)
+}
+
+// Header required by requests changing lists or cache
+const adminHeader = "X-Overture-Admin"
+
+var (
+	adminLock sync.Mutex
+	ruleLists map[string]*ruleList
+)
+
+// initRuleLists must be called after srv and conf are changed, under adminLock
+func initRuleLists() {
+	ruleLists = map[string]*ruleList{
+		"block-domain": {
+			file:  conf.BlockFile.DomainFile,
+			parse: parseBlockDomain,
+			apply: func(lines []string) {
+				l := *srv.Lists()
+				l.BlockDomainList = conf.NewBlockDomainList(lines)
+				srv.SetLists(&l)
+			},
+		},
+		"block-ip": {
+			file:  conf.BlockFile.IPFile,
+			parse: parseBlockIP,
+			apply: func(lines []string) {
+				l := *srv.Lists()
+				l.BlockIPList = conf.NewBlockIPList(lines)
+				srv.SetLists(&l)
+			},
+		},
+		"hosts": {
+			file:  conf.HostsFile.HostsFile,
+			parse: parseHosts,
+			apply: func(lines []string) {
+				srv.SetHosts(conf.NewHosts(lines))
+			},
+		},
+		"replace-domain": {
+			file:  conf.ReplaceFile.DomainFile,
+			parse: parseReplaceDomain,
+			apply: func(lines []string) {
+				l := *srv.Lists()
+				l.ReplaceDomainList = conf.NewReplaceDomainList(lines)
+				srv.SetLists(&l)
+			},
+		},
+		"replace-ip": {
+			file:  conf.ReplaceFile.IPFile,
+			parse: parseReplaceIP,
+			apply: func(lines []string) {
+				l := *srv.Lists()
+				l.ReplaceIPList = conf.NewReplaceIPList(lines)
+				srv.SetLists(&l)
+			},
+		},
+	}
+}
+
+// reloadRuleList loads a list from its file again, entries edited but not saved are dropped
+func reloadRuleList(name string) {
+	adminLock.Lock()
+	defer adminLock.Unlock()
+
+	l := ruleLists[name]
+	l.lines = nil
+	l.load()
+	l.apply(l.entries())
+}
+
+func parseBlockDomain(query url.Values, isRemove bool) (string, func([]string) bool, error) {
+	domain := strings.TrimSpace(query.Get("domain"))
+	if domain == "" {
+		return "", nil, &errors.NormalError{Message: "domain is required"}
+	}
+	return domain, func(fields []string) bool { return fields[0] == domain }, nil
+}
+
+func parseBlockIP(query url.Values, isRemove bool) (string, func([]string) bool, error) {
+	ipNet, err := parseIPNetwork(query.Get("ip"))
+	if err != nil {
+		return "", nil, err
+	}
+	return ipNet, func(fields []string) bool { return fields[0] == ipNet }, nil
+}
+
+func parseHosts(query url.Values, isRemove bool) (string, func([]string) bool, error) {
+	domain := strings.TrimSuffix(strings.TrimSpace(query.Get("domain")), ".")
+	if domain == "" {
+		return "", nil, &errors.NormalError{Message: "domain is required"}
+	}
+	ip := net.ParseIP(query.Get("ip"))
+	if ip == nil {
+		if !isRemove || query.Get("ip") != "" {
+			return "", nil, &errors.NormalError{Message: "invalid ip: " + query.Get("ip")}
+		}
+		// Remove all addresses of the domain
+		return "", func(fields []string) bool { return len(fields) > 1 && fields[1] == domain }, nil
+	}
+	match := func(fields []string) bool {
+		return len(fields) > 1 && fields[1] == domain && net.ParseIP(fields[0]).Equal(ip)
+	}
+	return ip.String() + " " + domain, match, nil
+}
+
+func parseReplaceDomain(query url.Values, isRemove bool) (string, func([]string) bool, error) {
+	domain := strings.TrimSuffix(strings.TrimSpace(query.Get("domain")), ".")
+	if domain == "" {
+		return "", nil, &errors.NormalError{Message: "domain is required"}
+	}
+	match := func(fields []string) bool { return fields[0] == domain }
+	if isRemove {
+		return "", match, nil
+	}
+	to := strings.TrimSuffix(strings.TrimSpace(query.Get("to")), ".")
+	if to == "" {
+		return "", nil, &errors.NormalError{Message: "to is required"}
+	}
+	return domain + " " + to, match, nil
+}
+
+func parseReplaceIP(query url.Values, isRemove bool) (string, func([]string) bool, error) {
+	ipNet, err := parseIPNetwork(query.Get("ip"))
+	if err != nil {
+		return "", nil, err
+	}
+	match := func(fields []string) bool { return fields[0] == ipNet }
+	if isRemove {
+		return "", match, nil
+	}
+	to := net.ParseIP(query.Get("to"))
+	if to == nil {
+		return "", nil, &errors.NormalError{Message: "invalid to: " + query.Get("to")}
+	}
+	return ipNet + " " + to.String(), match, nil
+}
+
+// parseIPNetwork accepts both CIDR and single IP address, returns the CIDR
+func parseIPNetwork(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		if ip.To4() != nil {
+			return ip.String() + "/32", nil
+		}
+		return ip.String() + "/128", nil
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return "", &errors.NormalError{Message: "invalid ip: " + s}
+	}
+	return ipNet.String(), nil
+}
+
+// lineFields returns the fields of a line without comment, nil for an empty line
+func lineFields(line string) []string {
+	fields := strings.Fields(strings.Split(line, "#")[0])
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
+
+// Must be called under adminLock.
+func (l *ruleList) load() {
+	if l.lines != nil {
+		return
+	}
+	l.lines = []string{}
+	if l.file == "" {
+		return
+	}
+	b, err := os.ReadFile(l.file)
+	if err != nil {
+		log.Warnf("Failed to read %s: %s", l.file, err)
+		return
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		l.lines = append(l.lines, strings.TrimSuffix(line, "\r"))
+	}
+	// Drop the empty line after the last newline
+	if n := len(l.lines); n > 0 && l.lines[n-1] == "" {
+		l.lines = l.lines[:n-1]
+	}
+}
+
+// entries returns lines which are not empty or comments
+func (l *ruleList) entries() []string {
+	entries := []string{}
+	for _, line := range l.lines {
+		if lineFields(line) != nil {
+			entries = append(entries, strings.TrimSpace(line))
+		}
+	}
+	return entries
+}
+
+// add replaces the first line of the same entry, or appends it if there is not any
+func (l *ruleList) add(line string, match func([]string) bool) {
+	lines := make([]string, 0, len(l.lines)+1)
+	added := false
+	for _, old := range l.lines {
+		if fields := lineFields(old); fields != nil && match(fields) {
+			if !added {
+				lines = append(lines, line)
+				added = true
+			}
+			continue
+		}
+		lines = append(lines, old)
+	}
+	if !added {
+		lines = append(lines, line)
+	}
+	l.lines = lines
+}
+
+// remove returns the number of removed lines
+func (l *ruleList) remove(match func([]string) bool) int {
+	lines := make([]string, 0, len(l.lines))
+	for _, old := range l.lines {
+		if fields := lineFields(old); fields != nil && match(fields) {
+			continue
+		}
+		lines = append(lines, old)
+	}
+	removed := len(l.lines) - len(lines)
+	l.lines = lines
+	return removed
+}
+
+// save writes lines back to the file, a temporary file is written first so the file is never partial
+func (l *ruleList) save() error {
+	var b strings.Builder
+	for _, line := range l.lines {
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	tmp := l.file + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.file)
+}
+
+// AdminHandler is passed to http.Server for handle "/admin/" requests. GET lists entries of a list,
+// POST adds an entry and DELETE removes it, for example
+// "POST /admin/hosts?domain=example.com&ip=127.0.0.1". "DELETE /admin/cache" flushes the whole cache,
+// or entries of a name or a cache key with parameter name or key.
+//
+// Requests other than GET must have header X-Overture-Admin. A web page cannot send it to another
+// origin without a CORS preflight, which is never allowed, so sites visited by the operator cannot
+// edit lists through the browser.
+func AdminHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Header.Get(adminHeader) == "" {
+		http.Error(w, "header "+adminHeader+" is required", http.StatusForbidden)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/admin/")
+	if name == "cache" {
+		flushCache(w, r)
+		return
+	}
+
+	adminLock.Lock()
+	defer adminLock.Unlock()
+
+	l, ok := ruleLists[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	l.load()
+
+	if r.Method == http.MethodGet {
+		responseBytes, err := json.Marshal(l.entries())
+		if err != nil {
+			io.WriteString(w, err.Error())
+			return
+		}
+		io.WriteString(w, string(responseBytes))
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	isRemove := r.Method == http.MethodDelete
+	line, match, err := l.parse(r.URL.Query(), isRemove)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var result string
+	if isRemove {
+		n := l.remove(match)
+		if n == 0 {
+			http.Error(w, "entry not found", http.StatusNotFound)
+			return
+		}
+		result = "Removed " + strconv.Itoa(n)
+		log.Infof("Admin removed %d entries from %s", n, name)
+	} else {
+		l.add(line, match)
+		result = "Added"
+		log.Infof("Admin added %s to %s", line, name)
+	}
+	l.apply(l.entries())
+
+	if conf.AdminPersist && l.file != "" {
+		if isSubscribed(l.file) {
+			io.WriteString(w, result+", not saved since the list is subscribed")
+			return
+		}
+		if err := l.save(); err != nil {
+			log.Errorf("Failed to save %s: %s", l.file, err)
+			http.Error(w, result+", but failed to save: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result += " and saved"
+	}
+	io.WriteString(w, result)
+}
+
+// isSubscribed returns true if file is the copy of a subscription, must be called under adminLock
+func isSubscribed(file string) bool {
+	for _, s := range conf.Subscriptions {
+		if s.File == file {
+			return true
+		}
+	}
+	return false
+}
+
+func flushCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete && r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	c := srv.Dispatcher().Cache
+	if c == nil {
+		http.Error(w, "cache not enabled", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	var n int
+	switch {
+	case query.Get("key") != "":
+		if _, _, ok := c.Search(query.Get("key")); ok {
+			c.Remove(query.Get("key"))
+			n = 1
+		}
+	case query.Get("name") != "":
+		n = c.RemoveName(query.Get("name"))
+	default:
+		n = c.Flush()
+	}
+	log.Infof("Admin removed %d cache elements", n)
+	io.WriteString(w, "Removed "+strconv.Itoa(n))
+}
@@ -0,0 +1,115 @@
+package core
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/shawn1m/overture/core/cache"
+	"github.com/shawn1m/overture/core/config"
+	"github.com/shawn1m/overture/core/inbound"
+	"github.com/shawn1m/overture/core/outbound"
+	"github.com/shawn1m/overture/core/subscription"
+)
+
+func adminRequest(method string, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, target, nil)
+	r.Header.Set(adminHeader, "1")
+	AdminHandler(w, r)
+	return w
+}
+
+func TestAdminHandler(t *testing.T) {
+	dir := t.TempDir()
+	blockFile := filepath.Join(dir, "block_domain")
+	os.WriteFile(blockFile, []byte("# comment\nblocked.com\n"), 0644)
+
+	conf = &config.Config{AdminPersist: true}
+	conf.BlockFile.DomainFile = blockFile
+	conf.HostsFile.HostsFile = filepath.Join(dir, "hosts")
+	conf.BlockFile.IPFile = filepath.Join(dir, "subscribed_block_ip")
+	conf.Subscriptions = []*subscription.Subscription{{URL: "https://example.com/block_ip", File: conf.BlockFile.IPFile}}
+	c := cache.New(10, 0, 0)
+	defer c.Close()
+	srv = inbound.NewServer(nil, nil, nil, nil, nil, nil, outbound.Dispatcher{Cache: c}, nil, conf.NewBlockDomainList([]string{"blocked.com"}), nil, nil, nil)
+	initRuleLists()
+
+	w := httptest.NewRecorder()
+	AdminHandler(w, httptest.NewRequest(http.MethodPost, "/admin/block-domain?domain=example.com", nil))
+	if w.Code != http.StatusForbidden || srv.Lists().BlockDomainList.Has("example.com") {
+		t.Errorf("request without header %s should be rejected, got %d", adminHeader, w.Code)
+	}
+
+	if w := adminRequest(http.MethodPost, "/admin/block-domain?domain=example.com"); w.Code != http.StatusOK {
+		t.Fatalf("add: %d %s", w.Code, w.Body)
+	}
+	if !srv.Lists().BlockDomainList.Has("example.com") || !srv.Lists().BlockDomainList.Has("blocked.com") {
+		t.Error("block domain list should be rebuilt with the new entry")
+	}
+	if w := adminRequest(http.MethodDelete, "/admin/block-domain?domain=blocked.com"); w.Code != http.StatusOK {
+		t.Fatalf("remove: %d %s", w.Code, w.Body)
+	}
+	if srv.Lists().BlockDomainList.Has("blocked.com") {
+		t.Error("removed domain should not be blocked")
+	}
+	if w := adminRequest(http.MethodDelete, "/admin/block-domain?domain=blocked.com"); w.Code != http.StatusNotFound {
+		t.Errorf("removing a missing entry: %d", w.Code)
+	}
+	if b, _ := os.ReadFile(blockFile); string(b) != "# comment\nexample.com\n" {
+		t.Errorf("unexpected block file: %q", b)
+	}
+	if w := adminRequest(http.MethodGet, "/admin/block-domain"); w.Body.String() != `["example.com"]` {
+		t.Errorf("unexpected entries: %s", w.Body)
+	}
+
+	// Hosts file does not exist, it is created
+	if w := adminRequest(http.MethodPost, "/admin/hosts?domain=example.com&ip=127.0.0.1"); w.Code != http.StatusOK {
+		t.Fatalf("add hosts: %d %s", w.Code, w.Body)
+	}
+	if ipv4, _ := srv.Dispatcher().Hosts.Find("example.com."); len(ipv4) != 1 || !ipv4[0].Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("unexpected hosts: %v", ipv4)
+	}
+	if w := adminRequest(http.MethodPost, "/admin/hosts?domain=example.com&ip=bad"); w.Code != http.StatusBadRequest {
+		t.Errorf("bad ip: %d", w.Code)
+	}
+
+	// Not persisted without file
+	if w := adminRequest(http.MethodPost, "/admin/replace-ip?ip=10.0.0.0/8&to=127.0.0.1"); w.Code != http.StatusOK || strings.Contains(w.Body.String(), "saved") {
+		t.Fatalf("add replace ip: %d %s", w.Code, w.Body)
+	}
+	if ip := srv.Lists().ReplaceIPList.Find(net.ParseIP("10.1.1.1")); !ip.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("unexpected replaced ip: %s", ip)
+	}
+
+	// Subscribed lists are edited but not saved, the copy of the subscription would be overwritten
+	if w := adminRequest(http.MethodPost, "/admin/block-ip?ip=10.0.0.1"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "not saved") {
+		t.Fatalf("add subscribed block ip: %d %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(conf.BlockFile.IPFile); !os.IsNotExist(err) {
+		t.Errorf("subscribed file should not be written: %v", err)
+	}
+
+	c.InsertMessage("example.com. 1 ", newAdminTestMessage(), 0)
+	c.InsertMessage("example.net. 1 ", newAdminTestMessage(), 0)
+	if w := adminRequest(http.MethodDelete, "/admin/cache?name=example.com"); w.Body.String() != "Removed 1" {
+		t.Errorf("remove name: %s", w.Body)
+	}
+	if w := adminRequest(http.MethodDelete, "/admin/cache"); w.Body.String() != "Removed 1" || c.Len() != 0 {
+		t.Errorf("flush: %s", w.Body)
+	}
+}
+
+func newAdminTestMessage() *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	a, _ := dns.NewRR("example.com. 60 IN A 127.0.0.1")
+	m.Answer = append(m.Answer, a)
+	return m
+}
@@ -8,103 +8,395 @@ package cache
 // Cache that holds RRs.
 
 import (
+	"container/list"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/shawn1m/overture/core/common"
 )
 
+// Interval between two sweeps of expired elements
+const sweepInterval = time.Minute
+
+// Estimated memory used by an element besides the key and the packed message
+const elemOverhead = 256
+
+// TTL of stale answers, as recommended by RFC 8767
+const staleTTL = 30
+
 // Elem hold an answer and additional section that returned from the cache.
 // The signature is put in answer, extra is empty there. This wastes some memory.
 type elem struct {
-	expiration time.Time // time added + TTL, after this the elem is invalid
-	msg        *dns.Msg
+	key         string
+	expiration  time.Time // time added + TTL, after this the elem is invalid
+	ttl         time.Duration
+	msg         *dns.Msg
+	size        int
+	hits        int
+	prefetching bool
 }
 
-// Cache is a cache that holds on the a number of RRs or DNS messages. The cache
-// eviction is randomized.
+// Cache is a cache that holds on the a number of RRs or DNS messages. The least recently
+// used elements are evicted when the cache is full, expired elements are swept periodically.
+// If staleWindow is set, expired elements are kept for that long so they can be served when
+// upstreams fail (RFC 8767).
 type Cache struct {
-	sync.RWMutex
+	sync.Mutex
+
+	capacity    int
+	maxBytes    int
+	bytes       int
+	staleWindow time.Duration
 
-	capacity int
-	table    map[string]*elem
+	// Elements hit at least prefetchHits times are prefetched when the remaining TTL is
+	// less than prefetchPercent of the original TTL
+	prefetchPercent int
+	prefetchHits    int
+
+	// Negative responses are cached for at most maximumNegativeTTL seconds if it is set
+	maximumNegativeTTL uint32
+	table              map[string]*list.Element
+	lru                *list.List // front is the most recently used
+
+	evictions uint64
+	file      string // saved to file when closed
+	movedTo   *Cache // elements inserted after MoveFrom go to it
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
-// New returns a new cache with the capacity and the ttl specified.
-func New(capacity int) *Cache {
+// New returns a new cache with the capacity specified. If maxBytes is greater than zero, the
+// estimated memory used by cached messages is also limited to it. Expired elements are kept
+// for staleWindow to serve stale answers.
+func New(capacity int, maxBytes int, staleWindow time.Duration) *Cache {
 	if capacity <= 0 {
 		return nil
 	}
 	c := new(Cache)
-	c.table = make(map[string]*elem)
+	c.table = make(map[string]*list.Element)
+	c.lru = list.New()
 	c.capacity = capacity
+	c.maxBytes = maxBytes
+	c.staleWindow = staleWindow
+	c.done = make(chan struct{})
+	go c.sweepLoop()
 	return c
 }
 
 func (c *Cache) Capacity() int { return c.capacity }
 
-func (c *Cache) Remove(s string) {
+func (c *Cache) MaxBytes() int { return c.maxBytes }
+
+// ServeStale returns true if expired elements are kept to serve stale answers
+func (c *Cache) ServeStale() bool { return c != nil && c.staleWindow > 0 }
+
+// SetMaximumNegativeTTL caps the TTL of cached negative responses
+func (c *Cache) SetMaximumNegativeTTL(ttl uint32) {
+	if c == nil {
+		return
+	}
 	c.Lock()
-	delete(c.table, s)
+	c.maximumNegativeTTL = ttl
 	c.Unlock()
 }
 
-// EvictRandom removes a random member a the cache.
-// Must be called under a write lock.
-func (c *Cache) EvictRandom() {
-	cacheLength := len(c.table)
-	if cacheLength <= c.capacity {
+// SetPrefetch enables prefetching of elements which have been hit at least hits times, when their
+// remaining TTL falls under percent of the original TTL.
+func (c *Cache) SetPrefetch(percent int, hits int) {
+	if c == nil {
 		return
 	}
-	i := c.capacity - cacheLength
-	for k := range c.table {
-		delete(c.table, k)
-		i--
-		if i == 0 {
-			break
+	c.Lock()
+	c.prefetchPercent = percent
+	c.prefetchHits = hits
+	c.Unlock()
+}
+
+// Prefetch returns true if the element should be prefetched now. The element is marked as
+// prefetching, so it is only prefetched once until PrefetchDone is called or it is replaced.
+func (c *Cache) Prefetch(s string) bool {
+	if c == nil {
+		return false
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.prefetchPercent <= 0 {
+		return false
+	}
+	e, ok := c.table[s]
+	if !ok {
+		return false
+	}
+	el := e.Value.(*elem)
+	remaining := time.Until(el.expiration)
+	if el.prefetching || el.hits < c.prefetchHits || remaining <= 0 || remaining*100 >= el.ttl*time.Duration(c.prefetchPercent) {
+		return false
+	}
+	el.prefetching = true
+	return true
+}
+
+// PrefetchDone allows the element to be prefetched again, it is used when prefetching failed
+func (c *Cache) PrefetchDone(s string) {
+	c.Lock()
+	if e, ok := c.table[s]; ok {
+		e.Value.(*elem).prefetching = false
+	}
+	c.Unlock()
+}
+
+// Bytes returns the estimated memory used by cached messages
+func (c *Cache) Bytes() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.bytes
+}
+
+// Len returns the number of elements in the cache
+func (c *Cache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.table)
+}
+
+// Evictions returns the number of elements evicted because the cache was full
+func (c *Cache) Evictions() uint64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.evictions
+}
+
+// Close stops sweeping expired elements, and saves the cache if persistence is set
+func (c *Cache) Close() {
+	if c == nil {
+		return
+	}
+	c.stop(true)
+}
+
+// Discard stops sweeping expired elements without saving, for a cache which is never used
+func (c *Cache) Discard() {
+	if c == nil {
+		return
+	}
+	c.stop(false)
+}
+
+// stop stops sweeping and saving periodically, and saves the cache to file if save is true
+func (c *Cache) stop(save bool) {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.Lock()
+		file := c.file
+		c.Unlock()
+		if save && file != "" {
+			if err := c.Save(file); err != nil {
+				log.Warnf("Failed to save cache: %s", err)
+			}
+		}
+	})
+}
+
+// MoveFrom moves all elements of the old cache into c, the recently used order is kept. The old cache
+// is stopped without being saved, c owns the cache file from now on. Messages inserted into the old
+// cache later, by queries in flight, are inserted into c.
+func (c *Cache) MoveFrom(old *Cache) {
+	if c == nil || old == nil || c == old {
+		return
+	}
+	old.stop(false)
+
+	old.Lock()
+	defer old.Unlock()
+	c.Lock()
+	defer c.Unlock()
+	old.movedTo = c
+	for e := old.lru.Back(); e != nil; e = e.Prev() {
+		el := e.Value.(*elem)
+		if ce, ok := c.table[el.key]; ok {
+			c.removeElement(ce)
+		}
+		c.table[el.key] = c.lru.PushFront(el)
+		c.bytes += el.size
+	}
+	c.EvictLRU()
+	old.table = make(map[string]*list.Element)
+	old.lru.Init()
+	old.bytes = 0
+}
+
+func (c *Cache) Remove(s string) {
+	c.Lock()
+	if e, ok := c.table[s]; ok {
+		c.removeElement(e)
+	}
+	c.Unlock()
+}
+
+// RemoveName removes elements of name in all types and EDNS client subnets, returns the number of
+// removed elements
+func (c *Cache) RemoveName(name string) int {
+	prefix := dns.Fqdn(strings.ToLower(name)) + " "
+	c.Lock()
+	defer c.Unlock()
+	count := 0
+	for k, e := range c.table {
+		if strings.HasPrefix(strings.ToLower(k), prefix) {
+			c.removeElement(e)
+			count++
+		}
+	}
+	return count
+}
+
+// Flush removes all elements, returns the number of removed elements
+func (c *Cache) Flush() int {
+	c.Lock()
+	defer c.Unlock()
+	count := len(c.table)
+	c.table = make(map[string]*list.Element)
+	c.lru.Init()
+	c.bytes = 0
+	return count
+}
+
+// Must be called under the lock.
+func (c *Cache) removeElement(e *list.Element) {
+	el := c.lru.Remove(e).(*elem)
+	delete(c.table, el.key)
+	c.bytes -= el.size
+}
+
+// EvictLRU removes the least recently used elements until the cache fits in its bounds.
+// Must be called under the lock.
+func (c *Cache) EvictLRU() {
+	for len(c.table) > c.capacity || (c.maxBytes > 0 && c.bytes > c.maxBytes && len(c.table) > 1) {
+		e := c.lru.Back()
+		if e == nil {
+			return
 		}
+		c.removeElement(e)
+		c.evictions++
 	}
 }
 
-// InsertMessage inserts a message in the Cache. We will cache it for ttl seconds, which
-// should be a small (60...300) integer.
+// Sweep removes all expired elements which are out of the stale window
+func (c *Cache) Sweep() {
+	now := time.Now().Add(-c.staleWindow)
+	c.Lock()
+	removed := 0
+	for e := c.lru.Back(); e != nil; {
+		prev := e.Prev()
+		if now.After(e.Value.(*elem).expiration) {
+			c.removeElement(e)
+			removed++
+		}
+		e = prev
+	}
+	c.Unlock()
+	if removed > 0 {
+		log.Debugf("Swept %d expired cache elements", removed)
+	}
+}
+
+func (c *Cache) sweepLoop() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.Sweep()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// InsertMessage inserts a message in the Cache. Positive responses are cached for the minimum TTL of
+// all answer records, negative responses (NXDOMAIN and NODATA) are cached for the TTL derived from SOA
+// as described in RFC 2308. If there is neither answer nor SOA, the message is cached for mTTL seconds.
 func (c *Cache) InsertMessage(s string, m *dns.Msg, mTTL uint32) {
 	if c.capacity <= 0 || m == nil {
 		return
 	}
-
 	c.Lock()
-	var ttl uint32
-	if len(m.Answer) == 0 {
-		ttl = mTTL
-	} else {
-		ttl = m.Answer[0].Header().Ttl
+	movedTo := c.movedTo
+	c.Unlock()
+	if movedTo != nil {
+		movedTo.InsertMessage(s, m, mTTL)
+		return
 	}
+
+	ttl := c.getTTL(m, mTTL)
 	ttlDuration := time.Duration(ttl) * time.Second
-	if _, ok := c.table[s]; !ok {
-		c.table[s] = &elem{time.Now().Add(ttlDuration), m.Copy()}
+	el := &elem{key: s, expiration: time.Now().Add(ttlDuration), ttl: ttlDuration, msg: m.Copy()}
+	el.size = len(s) + el.msg.Len() + elemOverhead
+
+	c.Lock()
+	if e, ok := c.table[s]; ok {
+		c.removeElement(e)
 	}
+	c.table[s] = c.lru.PushFront(el)
+	c.bytes += el.size
 	log.Debugf("Cached: %s", s)
-	c.EvictRandom()
+	c.EvictLRU()
 	c.Unlock()
 }
 
+func (c *Cache) getTTL(m *dns.Msg, mTTL uint32) uint32 {
+	answerTTL, hasAnswer := common.GetMinimumAnswerTTL(m)
+	if len(m.Question) > 0 && common.HasType(m, m.Question[0].Qtype) {
+		return answerTTL
+	}
+
+	negativeTTL, ok := common.GetNegativeTTL(m)
+	if !ok {
+		if hasAnswer {
+			return answerTTL
+		}
+		return mTTL
+	}
+	c.Lock()
+	maximumNegativeTTL := c.maximumNegativeTTL
+	c.Unlock()
+	if maximumNegativeTTL > 0 && negativeTTL > maximumNegativeTTL {
+		negativeTTL = maximumNegativeTTL
+	}
+	// CNAME records before NODATA
+	if hasAnswer && answerTTL < negativeTTL {
+		negativeTTL = answerTTL
+	}
+	return negativeTTL
+}
+
 // Search returns a dns.Msg, the expiration time and a boolean indicating if we found something
 // in the cache.
 // todo: use finder implementation
 func (c *Cache) Search(s string) (*dns.Msg, time.Time, bool) {
+	return c.search(s, false)
+}
+
+// search also counts hits of unexpired elements if countHit is true
+func (c *Cache) search(s string, countHit bool) (*dns.Msg, time.Time, bool) {
 	if c.capacity <= 0 {
 		return nil, time.Time{}, false
 	}
-	c.RLock()
+	c.Lock()
 	if e, ok := c.table[s]; ok {
-		e1 := e.msg.Copy()
-		c.RUnlock()
-		return e1, e.expiration, true
+		c.lru.MoveToFront(e)
+		el := e.Value.(*elem)
+		if countHit && time.Now().Before(el.expiration) {
+			el.hits++
+		}
+		c.Unlock()
+		return el.msg.Copy(), el.expiration, true
 	}
-	c.RUnlock()
+	c.Unlock()
 	return nil, time.Time{}, false
 }
 
@@ -114,33 +406,65 @@ func Key(q dns.Question, ednsIP string) string {
 }
 
 // Hit returns a dns message from the cache. If the message's TTL is expired nil
-// is returned and the message is removed from the cache.
+// is returned and the message is removed from the cache, unless it is in the stale window.
 func (c *Cache) Hit(key string, msgid uint16) *dns.Msg {
-	m, exp, hit := c.Search(key)
+	m, exp, hit := c.search(key, true)
 	if hit {
 		// Cache hit! \o/
 		if time.Since(exp) < 0 {
-			m.Id = msgid
-			m.Compress = true
-			// Even if something ended up with the TC bit *in* the cache, set it to off
-			m.Truncated = false
-			for _, a := range m.Answer {
-				a.Header().Ttl = uint32(time.Since(exp).Seconds() * -1)
-			}
+			setReply(m, msgid, uint32(time.Since(exp).Seconds()*-1))
 			return m
 		}
 		// Expired! /o\
-		c.Remove(key)
+		if time.Since(exp) > c.staleWindow {
+			c.Remove(key)
+		}
 	}
 	return nil
 }
 
-// Dump returns all dns cache information, for dubugging
+// HitStale returns a dns message from the cache even if it is expired, as long as it is in the
+// stale window. The TTL of a stale message is set to 30 seconds.
+func (c *Cache) HitStale(key string, msgid uint16) *dns.Msg {
+	if !c.ServeStale() {
+		return nil
+	}
+	m, exp, hit := c.Search(key)
+	if !hit || time.Since(exp) > c.staleWindow {
+		return nil
+	}
+	ttl := uint32(staleTTL)
+	if time.Since(exp) < 0 && uint32(time.Since(exp).Seconds()*-1) < ttl {
+		ttl = uint32(time.Since(exp).Seconds() * -1)
+	}
+	setReply(m, msgid, ttl)
+	return m
+}
+
+func setReply(m *dns.Msg, msgid uint16, ttl uint32) {
+	m.Id = msgid
+	m.Compress = true
+	// Even if something ended up with the TC bit *in* the cache, set it to off
+	m.Truncated = false
+	for _, a := range m.Answer {
+		a.Header().Ttl = ttl
+	}
+	for _, ns := range m.Ns {
+		if ns.Header().Rrtype == dns.TypeSOA {
+			ns.Header().Ttl = ttl
+		}
+	}
+}
+
+// Dump returns all dns cache information, for dubugging. Expired elements are skipped.
 func (c *Cache) Dump(nobody bool) (rs map[string][]string, l int) {
 	if c.capacity <= 0 {
 		return
 	}
 
+	c.Lock()
+	defer c.Unlock()
+
 	l = len(c.table)
 
 	rs = make(map[string][]string)
@@ -149,13 +473,16 @@ func (c *Cache) Dump(nobody bool) (rs map[string][]string, l int) {
 		return
 	}
 
-	c.RLock()
-	defer c.RUnlock()
-
+	now := time.Now()
 	for k, e := range c.table {
+		el := e.Value.(*elem)
+		if now.After(el.expiration) {
+			continue
+		}
+
 		var vs []string
 
-		for _, a := range e.msg.Answer {
+		for _, a := range el.msg.Answer {
 			vs = append(vs, a.String())
 		}
 		rs[k] = vs
@@ -0,0 +1,216 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newTestMessage(name string, ttl uint32) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	a, _ := dns.NewRR(name + " " + "IN A 127.0.0.1")
+	a.Header().Ttl = ttl
+	m.Answer = append(m.Answer, a)
+	return m
+}
+
+func TestCacheLRU(t *testing.T) {
+	c := New(2, 0, 0)
+	defer c.Close()
+
+	c.InsertMessage("a", newTestMessage("a.example.", 60), 0)
+	c.InsertMessage("b", newTestMessage("b.example.", 60), 0)
+	// "a" becomes the most recently used one
+	if c.Hit("a", 0) == nil {
+		t.Fatal("a should be cached")
+	}
+	c.InsertMessage("c", newTestMessage("c.example.", 60), 0)
+
+	if c.Len() != 2 {
+		t.Errorf("cache length is %d, want 2", c.Len())
+	}
+	if c.Hit("b", 0) != nil {
+		t.Error("b should be evicted")
+	}
+	if c.Hit("a", 0) == nil || c.Hit("c", 0) == nil {
+		t.Error("a and c should be cached")
+	}
+	if c.Evictions() != 1 {
+		t.Errorf("evictions is %d, want 1", c.Evictions())
+	}
+}
+
+func TestCacheMaxBytes(t *testing.T) {
+	size := len("a") + newTestMessage("a.example.", 60).Len() + elemOverhead
+	c := New(100, size*3, 0)
+	defer c.Close()
+
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		c.InsertMessage(k, newTestMessage(k+".example.", 60), 0)
+	}
+	if c.Len() != 3 {
+		t.Errorf("cache length is %d, want 3", c.Len())
+	}
+	if c.Bytes() > c.MaxBytes() {
+		t.Errorf("cache uses %d bytes, more than %d", c.Bytes(), c.MaxBytes())
+	}
+	if c.Hit("a", 0) != nil || c.Hit("e", 0) == nil {
+		t.Error("the oldest elements should be evicted")
+	}
+}
+
+func TestCacheSweep(t *testing.T) {
+	c := New(10, 0, 0)
+	defer c.Close()
+
+	c.InsertMessage("expired", newTestMessage("expired.example.", 0), 0)
+	c.InsertMessage("valid", newTestMessage("valid.example.", 60), 0)
+	time.Sleep(10 * time.Millisecond)
+
+	if rs, _ := c.Dump(false); len(rs) != 1 {
+		t.Errorf("dump should only contain valid elements, got %v", rs)
+	}
+	c.Sweep()
+	if c.Len() != 1 {
+		t.Errorf("cache length is %d after sweep, want 1", c.Len())
+	}
+	if c.Hit("valid", 0) == nil {
+		t.Error("valid element should not be swept")
+	}
+}
+
+func TestCacheServeStale(t *testing.T) {
+	c := New(10, 0, time.Minute)
+	defer c.Close()
+
+	c.InsertMessage("a", newTestMessage("a.example.", 0), 0)
+	time.Sleep(10 * time.Millisecond)
+
+	if c.Hit("a", 0) != nil {
+		t.Error("expired element should not be hit")
+	}
+	m := c.HitStale("a", 1)
+	if m == nil {
+		t.Fatal("expired element in the stale window should be kept")
+	}
+	if m.Id != 1 || m.Answer[0].Header().Ttl != staleTTL {
+		t.Errorf("unexpected stale message: %v", m)
+	}
+
+	c.InsertMessage("b", newTestMessage("b.example.", 3600), 0)
+	if m := c.HitStale("b", 0); m == nil || m.Answer[0].Header().Ttl != staleTTL {
+		t.Errorf("stale TTL should be %d, got %v", staleTTL, m)
+	}
+
+	c.Sweep()
+	if c.Len() != 2 {
+		t.Errorf("elements in the stale window should not be swept")
+	}
+}
+
+func TestCachePrefetch(t *testing.T) {
+	c := New(10, 0, 0)
+	defer c.Close()
+	c.SetPrefetch(50, 2)
+
+	c.InsertMessage("a", newTestMessage("a.example.", 2), 0)
+	c.Hit("a", 0)
+	c.Hit("a", 0)
+	if c.Prefetch("a") {
+		t.Error("remaining TTL is still above the threshold")
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if !c.Prefetch("a") {
+		t.Error("element should be prefetched")
+	}
+	if c.Prefetch("a") {
+		t.Error("element should only be prefetched once")
+	}
+	c.PrefetchDone("a")
+	if !c.Prefetch("a") {
+		t.Error("element should be prefetched again after PrefetchDone")
+	}
+
+	c.InsertMessage("b", newTestMessage("b.example.", 1), 0)
+	time.Sleep(600 * time.Millisecond)
+	c.Hit("b", 0)
+	if c.Prefetch("b") {
+		t.Error("element which is not hit enough should not be prefetched")
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	c := New(10, 0, 0)
+	defer c.Close()
+	c.SetMaximumNegativeTTL(600)
+
+	newNegativeMessage := func(name string, soaTTL uint32, soaMinimum string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		m.Rcode = dns.RcodeNameError
+		soa, _ := dns.NewRR(name + " IN SOA ns.example. hostmaster.example. 1 7200 3600 1209600 " + soaMinimum)
+		soa.Header().Ttl = soaTTL
+		m.Ns = append(m.Ns, soa)
+		return m
+	}
+
+	positive := newTestMessage("positive.example.", 300)
+	a, _ := dns.NewRR("positive.example. 60 IN A 127.0.0.2")
+	positive.Answer = append(positive.Answer, a)
+
+	var tests = []struct {
+		name string
+		msg  *dns.Msg
+		want uint32
+	}{
+		{"positive", positive, 60},
+		{"soa-ttl", newNegativeMessage("soa-ttl.example.", 100, "300"), 100},
+		{"soa-minimum", newNegativeMessage("soa-minimum.example.", 300, "200"), 200},
+		{"capped", newNegativeMessage("capped.example.", 3600, "86400"), 600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c.InsertMessage(tt.name, tt.msg, 0)
+			m := c.Hit(tt.name, 0)
+			if m == nil {
+				t.Fatal("message should be cached")
+			}
+			var ttl uint32
+			if len(m.Answer) > 0 {
+				ttl = m.Answer[0].Header().Ttl
+			} else {
+				ttl = m.Ns[0].Header().Ttl
+			}
+			if ttl > tt.want || ttl < tt.want-1 {
+				t.Errorf("TTL is %d, want %d", ttl, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheRemoveName(t *testing.T) {
+	c := New(10, 0, 0)
+	defer c.Close()
+
+	for _, q := range []dns.Question{
+		{Name: "a.example.", Qtype: dns.TypeA},
+		{Name: "a.example.", Qtype: dns.TypeAAAA},
+		{Name: "b.a.example.", Qtype: dns.TypeA},
+	} {
+		c.InsertMessage(Key(q, ""), newTestMessage(q.Name, 60), 0)
+	}
+	c.InsertMessage(Key(dns.Question{Name: "a.example.", Qtype: dns.TypeA}, "1.2.3.0"), newTestMessage("a.example.", 60), 0)
+
+	if n := c.RemoveName("A.example"); n != 3 {
+		t.Errorf("removed %d elements, want 3", n)
+	}
+	if c.Len() != 1 {
+		t.Errorf("b.a.example should be kept, %d elements left", c.Len())
+	}
+	if n := c.Flush(); n != 1 || c.Len() != 0 || c.Bytes() != 0 {
+		t.Errorf("flushed %d elements, %d left with %d bytes", n, c.Len(), c.Bytes())
+	}
+}
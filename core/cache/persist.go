@@ -0,0 +1,142 @@
+// Copyright (c) 2016 shawn1m. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package cache
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// record is an element in cache file, one record per line. The expiration is wall-clock time, so
+// the remaining TTL is preserved across restarts.
+type record struct {
+	Key        string    `json:"key"`
+	Expiration time.Time `json:"expiration"`
+	TTL        uint32    `json:"ttl"`
+	Msg        []byte    `json:"msg"`
+}
+
+// SetPersistence saves the cache to file every interval and when the cache is closed. If interval
+// is zero, the cache is only saved when it is closed.
+func (c *Cache) SetPersistence(file string, interval time.Duration) {
+	if c == nil || file == "" {
+		return
+	}
+	c.Lock()
+	c.file = file
+	c.Unlock()
+	if interval > 0 {
+		go c.saveLoop(file, interval)
+	}
+}
+
+func (c *Cache) saveLoop(file string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.Save(file); err != nil {
+				log.Warnf("Failed to save cache: %s", err)
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Save writes all elements in the stale window to file, from the least recently used one.
+func (c *Cache) Save(file string) error {
+	var records []*record
+	now := time.Now().Add(-c.staleWindow)
+	c.Lock()
+	for e := c.lru.Back(); e != nil; e = e.Prev() {
+		el := e.Value.(*elem)
+		if now.After(el.expiration) {
+			continue
+		}
+		b, err := el.msg.Pack()
+		if err != nil {
+			continue
+		}
+		records = append(records, &record{Key: el.key, Expiration: el.expiration, TTL: uint32(el.ttl / time.Second), Msg: b})
+	}
+	c.Unlock()
+
+	// Write to a temporary file first, so the old cache file is kept if anything goes wrong
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	for _, r := range records {
+		if err = encoder.Encode(r); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return err
+	}
+	log.Debugf("Saved %d cache elements to %s", len(records), file)
+	return nil
+}
+
+// Load restores elements from file, elements out of the stale window are dropped.
+func (c *Cache) Load(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	now := time.Now().Add(-c.staleWindow)
+	count := 0
+	decoder := json.NewDecoder(bufio.NewReader(f))
+	for decoder.More() {
+		r := new(record)
+		if err := decoder.Decode(r); err != nil {
+			return err
+		}
+		if now.After(r.Expiration) {
+			continue
+		}
+		m := new(dns.Msg)
+		if err := m.Unpack(r.Msg); err != nil {
+			log.Debugf("Failed to unpack cached message %s: %s", r.Key, err)
+			continue
+		}
+		el := &elem{key: r.Key, expiration: r.Expiration, ttl: time.Duration(r.TTL) * time.Second, msg: m}
+		el.size = len(r.Key) + m.Len() + elemOverhead
+
+		c.Lock()
+		if e, ok := c.table[r.Key]; ok {
+			c.removeElement(e)
+		}
+		c.table[r.Key] = c.lru.PushFront(el)
+		c.bytes += el.size
+		c.EvictLRU()
+		c.Unlock()
+		count++
+	}
+	log.Infof("Loaded %d cache elements from %s", count, file)
+	return nil
+}
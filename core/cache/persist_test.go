@@ -0,0 +1,74 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCachePersistence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "cache.json")
+
+	c := New(10, 0, 0)
+	c.SetPersistence(file, 0)
+	c.InsertMessage("expired", newTestMessage("expired.example.", 0), 0)
+	c.InsertMessage("a", newTestMessage("a.example.", 60), 0)
+	c.InsertMessage("b", newTestMessage("b.example.", 60), 0)
+	c.Hit("a", 0)
+	time.Sleep(10 * time.Millisecond)
+	c.Close()
+
+	time.Sleep(1100 * time.Millisecond)
+	n := New(2, 0, 0)
+	defer n.Close()
+	if err := n.Load(file); err != nil {
+		t.Fatal(err)
+	}
+	if n.Len() != 2 {
+		t.Errorf("cache length is %d, want 2", n.Len())
+	}
+	m := n.Hit("a", 0)
+	if m == nil {
+		t.Fatal("a should be restored")
+	}
+	if ttl := m.Answer[0].Header().Ttl; ttl >= 59 {
+		t.Errorf("remaining TTL should be based on wall-clock time, got %d", ttl)
+	}
+
+	// "a" is the most recently used one, so "b" is evicted
+	n.InsertMessage("c", newTestMessage("c.example.", 60), 0)
+	if n.Hit("b", 0) != nil {
+		t.Error("recently used order should be restored")
+	}
+}
+
+func TestCacheMoveFrom(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "cache")
+	old := New(10, 0, 0)
+	old.SetPersistence(file, time.Hour)
+	old.InsertMessage("a", newTestMessage("a.example.", 60), 0)
+
+	c := New(10, 0, 0)
+	defer c.Close()
+	c.MoveFrom(old)
+	if c.Hit("a", 0) == nil {
+		t.Error("a should be moved")
+	}
+	if old.Len() != 0 {
+		t.Error("old cache should be empty")
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Error("old cache should not be saved when it is moved")
+	}
+
+	// Queries in flight may still insert into the old cache
+	old.InsertMessage("b", newTestMessage("b.example.", 60), 0)
+	if c.Hit("b", 0) == nil {
+		t.Error("b should be inserted into the new cache")
+	}
+	old.Close()
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Error("old cache should not be saved after it is moved")
+	}
+}
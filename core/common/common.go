@@ -68,6 +68,49 @@ func SetMinimumTTL(msg *dns.Msg, minimumTTL uint32) {
 	}
 }
 
+// SetMaximumTTL limits TTL of records in answer and authority section, so the SOA of a negative
+// response is not cached by clients longer than maximumTTL either
+func SetMaximumTTL(msg *dns.Msg, maximumTTL uint32) {
+	if maximumTTL == 0 {
+		return
+	}
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns} {
+		for _, a := range section {
+			if a.Header().Ttl > maximumTTL {
+				a.Header().Ttl = maximumTTL
+			}
+		}
+	}
+}
+
+// GetMinimumAnswerTTL returns the minimum TTL across all answer records, false if there is no answer
+func GetMinimumAnswerTTL(msg *dns.Msg) (uint32, bool) {
+	if len(msg.Answer) == 0 {
+		return 0, false
+	}
+	ttl := msg.Answer[0].Header().Ttl
+	for _, a := range msg.Answer[1:] {
+		if a.Header().Ttl < ttl {
+			ttl = a.Header().Ttl
+		}
+	}
+	return ttl, true
+}
+
+// GetNegativeTTL returns the TTL of a negative response (NXDOMAIN or NODATA) from the SOA record in
+// authority section, which is the minimum of the SOA TTL and the SOA MINIMUM field (RFC 2308).
+func GetNegativeTTL(msg *dns.Msg) (uint32, bool) {
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			if soa.Hdr.Ttl < soa.Minttl {
+				return soa.Hdr.Ttl, true
+			}
+			return soa.Minttl, true
+		}
+	}
+	return 0, false
+}
+
 func SetTTLByMap(msg *dns.Msg, domainTTLMap map[string]uint32) {
 	if len(domainTTLMap) == 0 {
 		return
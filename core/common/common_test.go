@@ -0,0 +1,23 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSetMaximumTTL(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("missing.example.com.", dns.TypeA)
+	m.Rcode = dns.RcodeNameError
+	soa, _ := dns.NewRR("example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 3600 86400 1800")
+	m.Ns = append(m.Ns, soa)
+
+	SetMaximumTTL(m, 60)
+	if ttl := m.Ns[0].Header().Ttl; ttl != 60 {
+		t.Errorf("SOA TTL is %d, want 60", ttl)
+	}
+	if ttl, _ := GetNegativeTTL(m); ttl != 60 {
+		t.Errorf("negative TTL is %d, want 60", ttl)
+	}
+}
@@ -0,0 +1,54 @@
+package common
+
+import (
+	"github.com/shawn1m/overture/core/matcher"
+)
+
+// UpstreamGroup is a named group of DNS upstreams, queried with the strategy of the group.
+type UpstreamGroup struct {
+	Name     string
+	Strategy string
+	DNS      []*DNSUpstream
+}
+
+// Rule selects the upstream group for a query. All configured conditions must match, a rule without
+// any condition matches every query. Rules are evaluated in order and the first match wins.
+//
+// If IPNetwork or IPNetworkFile is set, the rule also depends on the answer: the AnswerFrom group
+// (Group by default) is queried and the rule matches only if any A/AAAA answer is in the IP network.
+// When the answer is empty, WhenAnswerNone decides whether to use Group ("use", default) or to
+// continue with the next rule ("next"). ConcurrentGroup is queried at the same time, so it is ready
+// when a following rule picks it.
+//
+// Answers are checked in order. If ExceptIPNetworkSet is set, an answer in it before any answer in the
+// IP network makes the rule not match. Rules converted from PrimaryDNS and AlternativeDNS use it, so the
+// first answer in either IPNetworkFile decides the upstream.
+type Rule struct {
+	Tag           string
+	Group         string
+	Domain        []string
+	DomainFile    string
+	Matcher       string
+	QType         []uint16
+	ClientSubnet  []string
+	IPNetwork     []string
+	IPNetworkFile string
+
+	AnswerFrom      string
+	WhenAnswerNone  string
+	ConcurrentGroup string
+
+	DomainList      matcher.Matcher `json:"-"`
+	ClientSubnetSet *IPSet          `json:"-"`
+	IPNetworkSet    *IPSet          `json:"-"`
+
+	ExceptIPNetworkSet *IPSet `json:"-"`
+}
+
+// GetTag returns the tag used in query log
+func (r *Rule) GetTag() string {
+	if r.Tag != "" {
+		return r.Tag
+	}
+	return r.Group
+}
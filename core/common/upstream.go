@@ -14,4 +14,10 @@ type DNSUpstream struct {
 		IdleTimeout     int
 		MaxIdle         int
 	}
+	HealthCheck struct {
+		MaxFails      int
+		EjectTime     int
+		ProbeName     string
+		ProbeInterval int
+	}
 }
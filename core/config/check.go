@@ -0,0 +1,579 @@
+// Copyright (c) 2016 shawn1m. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package config
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+
+	"github.com/shawn1m/overture/core/common"
+	"github.com/shawn1m/overture/core/outbound/clients"
+	"github.com/shawn1m/overture/core/outbound/clients/resolver"
+	"github.com/shawn1m/overture/core/subscription"
+)
+
+// Problem is an error found in config file or a file referred by it. Line is 0 if it is unknown.
+type Problem struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (p *Problem) String() string {
+	if p.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", p.File, p.Line, p.Message)
+	}
+	return fmt.Sprintf("%s: %s", p.File, p.Message)
+}
+
+// Names accepted by settings, "" is the default one. They are derived from what the server creates, so
+// check and the server never disagree.
+var (
+	supportedProtocols  = resolver.Protocols()
+	supportedMatchers   = append([]string{""}, sortedKeys(domainMatchers)...)
+	supportedFinders    = append([]string{""}, sortedKeys(finders)...)
+	supportedStrategies = append([]string{""}, clients.Strategies()...)
+	supportedECSPolicy  = []string{"auto", "manual", "disable"}
+)
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// checker collects problems of a config file
+type checker struct {
+	file     string
+	lines    []string
+	format   string
+	problems []*Problem
+
+	// Directory of copies of subscriptions
+	cacheDir string
+
+	// found is the last line found by lineOf for a key and value, so repeated values are found in order
+	found map[string]int
+}
+
+// Check validates config file and files referred by it strictly, without side effects of NewConfig.
+// It returns all problems found.
+func Check(configFile string) []*Problem {
+	c := &checker{file: configFile, format: formatOfConfigFile(configFile), found: map[string]int{}}
+	b, err := os.ReadFile(configFile)
+	if err != nil {
+		c.addf(configFile, 0, "failed to read config file: %s", err)
+		return c.problems
+	}
+	c.lines = strings.Split(string(b), "\n")
+
+	v, err := decode(b, c.format)
+	if err != nil {
+		c.addf(configFile, c.errorLine(b, err), "failed to parse config file: %s", err)
+		return c.problems
+	}
+	c.checkUnknownFields(v, reflect.TypeOf(Config{}), "")
+
+	j, _ := json.Marshal(v)
+	conf := new(Config)
+	if err := json.Unmarshal(j, conf); err != nil {
+		message := err.Error()
+		if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+			message = fmt.Sprintf("%s should be %s, not %s", typeErr.Field, typeErr.Type, typeErr.Value)
+			c.configf(typeErr.Field[strings.LastIndex(typeErr.Field, ".")+1:], "", "%s", message)
+		} else {
+			c.addf(configFile, 0, "%s", message)
+		}
+		return c.problems
+	}
+	c.checkConfig(conf)
+	return c.problems
+}
+
+func (c *checker) addf(file string, line int, format string, args ...interface{}) {
+	c.problems = append(c.problems, &Problem{File: file, Line: line, Message: fmt.Sprintf(format, args...)})
+}
+
+// configf adds a problem of config file, at the line of key with value
+func (c *checker) configf(key string, value string, format string, args ...interface{}) {
+	c.addf(c.file, c.lineOf(key, value), format, args...)
+}
+
+// lineOf returns the line containing key (in the syntax of the format) and value, or 0. The next
+// line found is returned if it is called again with the same key and value.
+func (c *checker) lineOf(key string, value string) int {
+	id := key + "\x00" + value
+	for _, start := range []int{c.found[id], 0} {
+		for i := start; i < len(c.lines); i++ {
+			line := c.lines[i]
+			if value != "" && !strings.Contains(line, value) {
+				continue
+			}
+			if key == "" || c.hasKey(line, key) {
+				c.found[id] = i + 1
+				return i + 1
+			}
+		}
+	}
+	return 0
+}
+
+func (c *checker) hasKey(line string, key string) bool {
+	switch c.format {
+	case FormatYAML:
+		line = strings.TrimLeft(line, " \t-")
+		return strings.HasPrefix(line, key+":") || strings.HasPrefix(line, "\""+key+"\":")
+	case FormatTOML:
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			name := strings.Trim(line, "[] ")
+			return name == key || strings.HasSuffix(name, "."+key)
+		}
+		return strings.HasPrefix(line, key+" ") || strings.HasPrefix(line, key+"=")
+	default:
+		return strings.Contains(line, "\""+key+"\"")
+	}
+}
+
+// errorLine returns the line of a syntax error
+func (c *checker) errorLine(b []byte, err error) int {
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		return strings.Count(string(b[:e.Offset]), "\n") + 1
+	case toml.ParseError:
+		return e.Position.Line
+	}
+	// Errors of YAML have the line in message
+	if m := regexp.MustCompile(`line (\d+)`).FindStringSubmatch(err.Error()); m != nil {
+		line, _ := strconv.Atoi(m[1])
+		return line
+	}
+	return 0
+}
+
+// checkUnknownFields reports keys which are not fields of t, they are ignored when parsing
+func (c *checker) checkUnknownFields(v interface{}, t reflect.Type, path string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if t.Kind() != reflect.Struct {
+			return
+		}
+		// Keys are visited in the order of fields, which is usually the order in file, so that
+		// lineOf finds repeated keys in order
+		var keys, unknownKeys []string
+		for key := range v {
+			if _, ok := findField(t, key); ok {
+				keys = append(keys, key)
+			} else {
+				unknownKeys = append(unknownKeys, key)
+			}
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			a, _ := findField(t, keys[i])
+			b, _ := findField(t, keys[j])
+			return a.Index[0] < b.Index[0]
+		})
+		for _, key := range keys {
+			field, _ := findField(t, key)
+			c.checkUnknownFields(v[key], field.Type, path+field.Name+".")
+		}
+		sort.Strings(unknownKeys)
+		for _, key := range unknownKeys {
+			c.configf(key, "", "unknown field %s%s", path, key)
+		}
+	case []interface{}:
+		if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+			return
+		}
+		for i, e := range v {
+			c.checkUnknownFields(e, t.Elem(), fmt.Sprintf("%s%d.", path, i))
+		}
+	}
+}
+
+// findField finds the field of key case-insensitively, as encoding/json does
+func findField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		if strings.EqualFold(name, key) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func isOneOf(s string, list []string) bool {
+	for _, e := range list {
+		if s == e {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *checker) checkOneOf(key string, value string, list []string) {
+	if !isOneOf(value, list) {
+		c.configf(key, "\""+value+"\"", "unsupported %s %q", key, value)
+	}
+}
+
+// checkSettings checks names of protocols, matchers, finders, strategies and other options, which
+// LoadConfig also rejects
+func (c *checker) checkSettings(conf *Config) {
+	for _, g := range conf.UpstreamGroups {
+		c.checkOneOf("Strategy", g.Strategy, supportedStrategies)
+		c.checkUpstreamSettings(g.DNS)
+	}
+	c.checkUpstreamSettings(conf.PrimaryDNS)
+	c.checkUpstreamSettings(conf.AlternativeDNS)
+	c.checkOneOf("Primary", conf.UpstreamStrategy.Primary, supportedStrategies)
+	c.checkOneOf("Alternative", conf.UpstreamStrategy.Alternative, supportedStrategies)
+	c.checkOneOf("WhenPrimaryDNSAnswerNoneUse", conf.WhenPrimaryDNSAnswerNoneUse, []string{"", "PrimaryDNS", "AlternativeDNS"})
+	for _, r := range conf.Rules {
+		c.checkOneOf("WhenAnswerNone", r.WhenAnswerNone, []string{"", "use", "next"})
+		c.checkOneOf("Matcher", r.Matcher, supportedMatchers)
+	}
+	c.checkOneOf("Matcher", conf.DomainFile.Matcher, supportedMatchers)
+	c.checkOneOf("PrimaryMatcher", conf.DomainFile.PrimaryMatcher, supportedMatchers)
+	c.checkOneOf("AlternativeMatcher", conf.DomainFile.AlternativeMatcher, supportedMatchers)
+	c.checkOneOf("Matcher", conf.BlockFile.Matcher, supportedMatchers)
+	c.checkOneOf("Finder", conf.HostsFile.Finder, supportedFinders)
+	c.checkOneOf("Finder", conf.ReplaceFile.Finder, supportedFinders)
+	c.checkOneOf("QueryLogFormat", conf.QueryLogFormat, []string{"", "text", "json"})
+	if conf.Dnstap.Address != "" {
+		c.checkOneOf("Network", conf.Dnstap.Network, []string{"", "unix", "tcp", "file"})
+	}
+	if conf.DebugHTTP.Username == "" && conf.DebugHTTP.Password != "" {
+		c.configf("Password", "", "DebugHTTP.Password is set without Username")
+	} else if conf.DebugHTTP.Username != "" && conf.DebugHTTP.Password == "" {
+		c.configf("Username", "", "DebugHTTP.Username is set without Password")
+	}
+}
+
+// checkUpstreamSettings checks protocols and EDNSClientSubnet policies of upstreams
+func (c *checker) checkUpstreamSettings(upstreams []*common.DNSUpstream) {
+	for _, u := range upstreams {
+		if u.Protocol == "" {
+			c.configf("Name", u.Name, "upstream %s has no protocol", u.Name)
+		} else if !isOneOf(u.Protocol, supportedProtocols) {
+			c.configf("Protocol", "\""+u.Protocol+"\"", "unsupported protocol %q of upstream %s", u.Protocol, u.Name)
+		}
+		if u.EDNSClientSubnet != nil && !isOneOf(u.EDNSClientSubnet.Policy, supportedECSPolicy) {
+			c.configf("Policy", "\""+u.EDNSClientSubnet.Policy+"\"", "unsupported EDNSClientSubnet policy %q of upstream %s", u.EDNSClientSubnet.Policy, u.Name)
+		}
+	}
+}
+
+func (c *checker) checkConfig(conf *Config) {
+	c.checkSettings(conf)
+
+	c.cacheDir = conf.Subscription.CacheDir
+	if c.cacheDir == "" {
+		c.cacheDir = "./subscription"
+	}
+	for u := range conf.Subscription.Checksum {
+		if !subscription.IsURL(u) {
+			c.configf("", u, "checksum is set for %s which is not a URL", u)
+		}
+	}
+	for u, interval := range conf.Subscription.Intervals {
+		if !subscription.IsURL(u) {
+			c.configf("", u, "interval is set for %s which is not a URL", u)
+		} else if interval <= 0 {
+			c.configf("", u, "interval of %s should be positive", u)
+		}
+	}
+	groups := map[string]bool{}
+	if len(conf.PrimaryDNS) > 0 {
+		groups["Primary"] = true
+	}
+	if len(conf.AlternativeDNS) > 0 {
+		groups["Alternative"] = true
+	}
+	for _, g := range conf.UpstreamGroups {
+		if g.Name == "" {
+			c.configf("UpstreamGroups", "", "upstream group without name")
+		}
+		groups[g.Name] = true
+		c.checkUpstreams(g.DNS)
+	}
+	if len(groups) == 0 {
+		c.addf(c.file, 0, "no upstream DNS is configured")
+	}
+	c.checkUpstreams(conf.PrimaryDNS)
+	c.checkUpstreams(conf.AlternativeDNS)
+
+	for i, r := range conf.Rules {
+		for _, name := range []string{r.Group, r.AnswerFrom, r.ConcurrentGroup} {
+			if name != "" && !groups[name] {
+				c.configf("", "\""+name+"\"", "rule %d refers to upstream group %s which does not exist", i, name)
+			}
+		}
+		if r.Group == "" {
+			c.configf("Rules", "", "rule %d has no upstream group", i)
+		}
+		c.checkIPNetworkList("ClientSubnet", r.ClientSubnet)
+		c.checkIPNetworkList("IPNetwork", r.IPNetwork)
+		matcher := r.Matcher
+		if matcher == "" {
+			matcher = conf.DomainFile.Matcher
+		}
+		c.checkDomainFile(c.subscribed(r.DomainFile), matcher)
+		c.checkIPNetworkFile(c.subscribed(r.IPNetworkFile))
+	}
+
+	c.checkIPNetworkList("TrustedProxy", conf.DoH.TrustedProxy)
+	c.checkIPNetworkList("AllowedIP", conf.DebugHTTP.AllowedIP)
+
+	if len(conf.TLSBindAddress) > 0 || len(conf.QUICBindAddress) > 0 || len(conf.DoH.HTTPSBindAddress) > 0 {
+		c.checkCertificate(conf.TLSCertificate.CertFile, conf.TLSCertificate.KeyFile)
+	}
+	if conf.DebugHTTP.CertFile != "" {
+		c.checkCertificate(conf.DebugHTTP.CertFile, conf.DebugHTTP.KeyFile)
+	}
+
+	primaryMatcher, alternativeMatcher := conf.DomainFile.PrimaryMatcher, conf.DomainFile.AlternativeMatcher
+	if primaryMatcher == "" {
+		primaryMatcher = conf.DomainFile.Matcher
+	}
+	if alternativeMatcher == "" {
+		alternativeMatcher = conf.DomainFile.Matcher
+	}
+	c.checkDomainFile(c.subscribed(conf.DomainFile.Primary), primaryMatcher)
+	c.checkDomainFile(c.subscribed(conf.DomainFile.Alternative), alternativeMatcher)
+	c.checkDomainFile(c.subscribed(conf.BlockFile.DomainFile), conf.BlockFile.Matcher)
+	c.checkIPNetworkFile(c.subscribed(conf.IPNetworkFile.Primary))
+	c.checkIPNetworkFile(c.subscribed(conf.IPNetworkFile.Alternative))
+	c.checkIPNetworkFile(c.subscribed(conf.BlockFile.IPFile))
+	c.checkDomainTTLFile(conf.DomainTTLFile)
+	c.checkHostsFile(c.subscribed(conf.HostsFile.HostsFile), conf.HostsFile.Finder)
+	c.checkReplaceDomainFile(conf.ReplaceFile.DomainFile, conf.ReplaceFile.Finder)
+	c.checkReplaceIPFile(conf.ReplaceFile.IPFile)
+}
+
+func (c *checker) checkUpstreams(upstreams []*common.DNSUpstream) {
+	for _, u := range upstreams {
+		if u.Name == "" {
+			c.configf("Address", u.Address, "upstream %s has no name", u.Address)
+		}
+		if u.Address == "" {
+			c.configf("Name", u.Name, "upstream %s has no address", u.Name)
+		}
+		if u.Protocol == "quic" && u.SOCKS5Address != "" {
+			c.configf("SOCKS5Address", u.SOCKS5Address, "SOCKS5 proxy is not supported by quic protocol of upstream %s", u.Name)
+		}
+		if u.EDNSClientSubnet == nil {
+			c.configf("Name", u.Name, "upstream %s has no EDNSClientSubnet", u.Name)
+			continue
+		}
+		if ip := u.EDNSClientSubnet.ExternalIP; ip != "" && net.ParseIP(ip) == nil {
+			c.configf("ExternalIP", ip, "invalid ExternalIP %s of upstream %s", ip, u.Name)
+		}
+	}
+}
+
+func (c *checker) checkIPNetworkList(key string, list []string) {
+	for _, s := range list {
+		if net.ParseIP(s) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(s); err != nil {
+			c.configf(key, s, "invalid IP network %s in %s", s, key)
+		}
+	}
+}
+
+func (c *checker) checkCertificate(certFile string, keyFile string) {
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		c.configf("CertFile", certFile, "failed to load TLS certificate: %s", err)
+	}
+}
+
+// subscribed returns the downloaded copy of file if it is a URL. A URL which is not downloaded yet is
+// reported, since its rules are not used until the download succeeds, and "" is returned.
+func (c *checker) subscribed(file string) string {
+	if !subscription.IsURL(file) {
+		return file
+	}
+	copyFile := subscription.CacheFile(c.cacheDir, file)
+	if _, err := os.Stat(copyFile); err != nil {
+		c.configf("", file, "%s is not downloaded yet", file)
+		return ""
+	}
+	return copyFile
+}
+
+// checkFile calls check for every non-empty line of file, errors are reported with line numbers
+func (c *checker) checkFile(file string, check func(line string) error) {
+	if file == "" {
+		return
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		c.configf("", file, "%s", err)
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for i := 1; scanner.Scan(); i++ {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if err := check(line); err != nil {
+			c.addf(file, i, "%s", err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		c.addf(file, 0, "%s", err)
+	}
+}
+
+func (c *checker) checkDomainFile(file string, matcher string) {
+	if !isOneOf(matcher, supportedMatchers) || matcher == "final" {
+		return
+	}
+	if matcher == "" {
+		matcher = "full-map"
+	}
+	m := getDomainMatcher(matcher)
+	c.checkFile(file, func(line string) error {
+		line = strings.TrimSpace(line)
+		if err := m.Insert(line); err != nil {
+			return fmt.Errorf("invalid domain %s: %s", line, strings.TrimSpace(err.Error()))
+		}
+		switch matcher {
+		case "regex-list":
+			if _, err := regexp.Compile(line); err != nil {
+				return fmt.Errorf("invalid regex: %s", err)
+			}
+		case "mix-list":
+			kv := strings.Split(line, ":")
+			if len(kv) == 2 {
+				switch strings.ToLower(kv[0]) {
+				case "domain", "keyword", "full":
+				case "regex":
+					if _, err := regexp.Compile(strings.ToLower(kv[1])); err != nil {
+						return fmt.Errorf("invalid regex: %s", err)
+					}
+				default:
+					return fmt.Errorf("unsupported type %s", kv[0])
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (c *checker) checkIPNetworkFile(file string) {
+	c.checkFile(file, func(line string) error {
+		if _, _, err := net.ParseCIDR(line); err != nil {
+			return fmt.Errorf("invalid CIDR %q", line)
+		}
+		return nil
+	})
+}
+
+func (c *checker) checkDomainTTLFile(file string) {
+	c.checkFile(file, func(line string) error {
+		words := strings.Fields(line)
+		if len(words) < 2 {
+			return fmt.Errorf("no TTL for domain %s", words[0])
+		}
+		if _, err := strconv.ParseUint(words[1], 10, 32); err != nil {
+			return fmt.Errorf("invalid TTL %s for domain %s", words[1], words[0])
+		}
+		return nil
+	})
+}
+
+// replaceFields returns fields of a line in hosts or replace file, nil for comments
+func replaceFields(line string) []string {
+	return strings.Fields(strings.Split(line, "#")[0])
+}
+
+func checkFinderKey(finder string, key string) error {
+	if finder == "regex-list" {
+		if _, err := regexp.Compile(key); err != nil {
+			return fmt.Errorf("invalid regex: %s", err)
+		}
+	}
+	return nil
+}
+
+func (c *checker) checkHostsFile(file string, finder string) {
+	c.checkFile(file, func(line string) error {
+		fields := replaceFields(line)
+		if len(fields) == 0 {
+			return nil
+		}
+		if len(fields) < 2 {
+			return fmt.Errorf("no domain for %s", fields[0])
+		}
+		if net.ParseIP(fields[0]) == nil {
+			return fmt.Errorf("invalid IP %s", fields[0])
+		}
+		return checkFinderKey(finder, fields[1])
+	})
+}
+
+func (c *checker) checkReplaceDomainFile(file string, finder string) {
+	c.checkFile(file, func(line string) error {
+		fields := replaceFields(line)
+		if len(fields) == 0 {
+			return nil
+		}
+		if len(fields) < 2 {
+			return fmt.Errorf("no replacement for %s", fields[0])
+		}
+		return checkFinderKey(finder, fields[0])
+	})
+}
+
+func (c *checker) checkReplaceIPFile(file string) {
+	c.checkFile(file, func(line string) error {
+		fields := replaceFields(line)
+		if len(fields) == 0 {
+			return nil
+		}
+		if len(fields) < 2 {
+			return fmt.Errorf("no replacement for %s", fields[0])
+		}
+		if _, _, err := net.ParseCIDR(fields[0]); err != nil {
+			return fmt.Errorf("invalid CIDR %s", fields[0])
+		}
+		if net.ParseIP(fields[1]) == nil {
+			return fmt.Errorf("invalid IP %s", fields[1])
+		}
+		return nil
+	})
+}
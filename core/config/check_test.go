@@ -0,0 +1,120 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	dir := filepath.ToSlash(t.TempDir())
+	write := func(name string, content string) string {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return filepath.ToSlash(file)
+	}
+	domainFile := write("domain", "example.com\n[a-\n")
+	ipFile := write("ip", "1.0.0.0/8\n\n10.0.0.0/33\n")
+	ttlFile := write("ttl", "example.com 60\nexample.org x\n")
+	hostsFile := write("hosts", "# comment\n1.2.3.4 example.com\nexample.org\n")
+	configFile := write("config.json", `{
+  "BindAddress": [":53"],
+  "PrimaryDNS": [
+    {
+      "Name": "a",
+      "Address": "1.1.1.1:53",
+      "Protocol": "udp",
+      "EDNSClientSubnet": {"Policy": "disable"}
+    },
+    {
+      "Name": "b",
+      "Address": "1.1.1.1:53",
+      "Protocl": "udp",
+      "EDNSClientSubnet": {"Policy": "disable"}
+    }
+  ],
+  "Rules": [
+    {"Group": "Missing", "DomainFile": "`+domainFile+`", "Matcher": "regex-list"},
+    {"Group": "Primary", "IPNetworkFile": "`+ipFile+`", "ClientSubnet": ["10.0.0.0/8", "bad"]}
+  ],
+  "DomainTTLFile": "`+ttlFile+`",
+  "HostsFile": {"HostsFile": "`+hostsFile+`", "Finder": "full-map"},
+  "ReplaceFile": {"DomainFile": "`+dir+`/not-exist"}
+}`)
+
+	want := []string{
+		configFile + ":13: unknown field PrimaryDNS.1.Protocl",
+		configFile + ":11: upstream b has no protocol",
+		configFile + ":18: rule 0 refers to upstream group Missing which does not exist",
+		domainFile + ":2: invalid regex",
+		configFile + ":19: invalid IP network bad in ClientSubnet",
+		ipFile + ":3: invalid CIDR \"10.0.0.0/33\"",
+		ttlFile + ":2: invalid TTL x for domain example.org",
+		hostsFile + ":3: no domain for example.org",
+		configFile + ":23: open " + dir + "/not-exist",
+	}
+	problems := Check(configFile)
+	if len(problems) != len(want) {
+		t.Fatalf("got %d problems, want %d: %v", len(problems), len(want), problems)
+	}
+	for i, p := range problems {
+		if !strings.HasPrefix(p.String(), want[i]) {
+			t.Errorf("problem %d is %q, want %q", i, p, want[i])
+		}
+	}
+}
+
+func TestCheckSyntaxError(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(file, []byte("{\n  \"BindAddress\": [\":53\"],\n}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	problems := Check(file)
+	if len(problems) != 1 || problems[0].Line != 3 {
+		t.Errorf("got %v, want a problem at line 3", problems)
+	}
+}
+
+func TestCheckNotDownloaded(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	content := `{
+  "PrimaryDNS": [{"Name": "a", "Address": "1.1.1.1:53", "Protocol": "udp", "EDNSClientSubnet": {"Policy": "disable"}}],
+  "Subscription": {"CacheDir": "` + filepath.ToSlash(filepath.Dir(file)) + `"},
+  "Rules": [{"Group": "Primary", "DomainFile": "https://example.com/domain.txt"}]
+}`
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	problems := Check(file)
+	if len(problems) != 1 || !strings.Contains(problems[0].Message, "is not downloaded yet") {
+		t.Errorf("got %v, want a problem of the subscription not downloaded", problems)
+	}
+}
+
+func TestLoadConfigUnsupported(t *testing.T) {
+	upstream := `"Name": "a", "Address": "1.1.1.1:53", "EDNSClientSubnet": {"Policy": "disable"}`
+	tests := map[string]string{
+		"protocol": `{"PrimaryDNS": [{` + upstream + `, "Protocol": "udpp"}]}`,
+		"field":    `{"PrimaryDNS": [{` + upstream + `, "Protocl": "udp"}]}`,
+		"matcher":  `{"PrimaryDNS": [{` + upstream + `, "Protocol": "udp"}], "DomainFile": {"Matcher": "full"}}`,
+		"finder":   `{"PrimaryDNS": [{` + upstream + `, "Protocol": "udp"}], "HostsFile": {"Finder": "full"}}`,
+		"strategy": `{"UpstreamGroups": [{"Name": "g", "Strategy": "fast", "DNS": [{` + upstream + `, "Protocol": "udp"}]}]}`,
+		"cache":    `{"PrimaryDNS": [{` + upstream + `, "Protocol": "udp"}], "Cache": {}}`,
+		"hosts":    `{"PrimaryDNS": [{` + upstream + `, "Protocol": "udp"}], "Hosts": {}}`,
+	}
+	for name, content := range tests {
+		file := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadConfig(file); err == nil {
+			t.Errorf("unsupported %s is loaded", name)
+		}
+		if len(Check(file)) == 0 {
+			t.Errorf("unsupported %s is not reported by check", name)
+		}
+	}
+}
@@ -6,6 +6,8 @@ package config
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"io"
 	"io/ioutil"
@@ -13,16 +15,22 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/miekg/dns"
 	"github.com/shawn1m/overture/core/finder"
 	finderfull "github.com/shawn1m/overture/core/finder/full"
 	finderregex "github.com/shawn1m/overture/core/finder/regex"
 	"github.com/shawn1m/overture/core/querylog"
 	"github.com/shawn1m/overture/core/replace"
+	"github.com/shawn1m/overture/core/stats"
+	"github.com/shawn1m/overture/core/subscription"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/shawn1m/overture/core/cache"
 	"github.com/shawn1m/overture/core/common"
+	"github.com/shawn1m/overture/core/dnstap"
+	"github.com/shawn1m/overture/core/errors"
 	"github.com/shawn1m/overture/core/hosts"
 	"github.com/shawn1m/overture/core/matcher"
 	matcherfinal "github.com/shawn1m/overture/core/matcher/final"
@@ -33,15 +41,40 @@ import (
 )
 
 type Config struct {
-	FilePath                 string
+	FilePath                 string `json:"-"`
 	BindAddress              []string
+	TLSBindAddress           []string
+	QUICBindAddress          []string
 	DebugHTTPAddress         string
 	PrimaryDNS               []*common.DNSUpstream
 	AlternativeDNS           []*common.DNSUpstream
 	OnlyPrimaryDNS           bool
 	IPv6UseAlternativeDNS    bool
 	AlternativeDNSConcurrent bool
-	IPNetworkFile            struct {
+	UpstreamStrategy         struct {
+		Primary     string
+		Alternative string
+	}
+	TLSCertificate struct {
+		CertFile string
+		KeyFile  string
+	}
+	DoH struct {
+		HTTPSBindAddress []string
+		HTTPBindAddress  []string
+		Path             string
+		TrustedProxy     []string
+	}
+	DebugHTTP struct {
+		Token        string
+		Username     string
+		Password     string
+		CertFile     string
+		KeyFile      string
+		AllowedIP    []string
+		DisablePprof bool
+	}
+	IPNetworkFile struct {
 		Primary     string
 		Alternative string
 	}
@@ -56,11 +89,24 @@ type Config struct {
 		HostsFile string
 		Finder    string
 	}
-	MinimumTTL    int
-	DomainTTLFile string
-	CacheSize     int
-	RejectQType   []uint16
-	ReplaceFile   struct {
+	MinimumTTL         int
+	MaximumTTL         int
+	MaximumNegativeTTL int
+	DomainTTLFile      string
+	CacheSize          int
+	CacheMaxBytes      int
+	CacheFile          string
+	CacheSaveInterval  int
+	ServeStale         struct {
+		StaleWindow   int
+		ClientTimeout int
+	}
+	Prefetch struct {
+		TTLPercent int
+		MinHits    int
+	}
+	RejectQType []uint16
+	ReplaceFile struct {
 		DomainFile string
 		IPFile     string
 		Finder     string
@@ -70,40 +116,113 @@ type Config struct {
 		IPFile     string
 		Matcher    string
 	}
-	QueryLogFile string
+	QueryLogFile   string
+	QueryLogFormat string
+	Dnstap         struct {
+		Network    string
+		Address    string
+		Identity   string
+		BufferSize int
+	}
+	QueryLogRotate struct {
+		MaxSize    int
+		Interval   int
+		MaxBackups int
+		Compress   bool
+	}
+	StatsWindow  int
+	AdminPersist bool
+	AutoReload   bool
+	Subscription struct {
+		Interval      int
+		Timeout       int
+		SOCKS5Address string
+		CacheDir      string
+		Checksum      map[string]string
+		Intervals     map[string]int
+	}
+	UpstreamGroups []*common.UpstreamGroup
+	Rules          []*common.Rule
 
-	DomainTTLMap                map[string]uint32
-	DomainPrimaryList           matcher.Matcher
-	DomainAlternativeList       matcher.Matcher
+	DomainTTLMap                map[string]uint32 `json:"-"`
+	DomainPrimaryList           matcher.Matcher   `json:"-"`
+	DomainAlternativeList       matcher.Matcher   `json:"-"`
 	WhenPrimaryDNSAnswerNoneUse string
-	IPNetworkPrimarySet         *common.IPSet
-	IPNetworkAlternativeSet     *common.IPSet
-	Hosts                       *hosts.Hosts
-	Cache                       *cache.Cache
+	IPNetworkPrimarySet         *common.IPSet `json:"-"`
+	IPNetworkAlternativeSet     *common.IPSet `json:"-"`
+	Hosts                       *hosts.Hosts  `json:"-"`
+	Cache                       *cache.Cache  `json:"-"`
+	TLSConfig                   *tls.Config   `json:"-"`
+	DoHTrustedProxySet          *common.IPSet `json:"-"`
+	DebugHTTPTLSConfig          *tls.Config   `json:"-"`
+	DebugHTTPAllowedSet         *common.IPSet `json:"-"`
 
 	AlternativeFirst  bool
-	BlockDomainList   matcher.Matcher
-	BlockIPList       *common.IPSet
-	ReplaceDomainList *replace.DomainReplace
-	ReplaceIPList     *replace.IPReplace
+	BlockDomainList   matcher.Matcher        `json:"-"`
+	BlockIPList       *common.IPSet          `json:"-"`
+	ReplaceDomainList *replace.DomainReplace `json:"-"`
+	ReplaceIPList     *replace.IPReplace     `json:"-"`
+
+	SubscriptionClient *subscription.Client         `json:"-"`
+	Subscriptions      []*subscription.Subscription `json:"-"`
+
+	// Rules in config file, before files are loaded
+	ruleDefinitions []*common.Rule
 }
 
-// New config with json file and do some other initiate works
+// New config with json file and do some other initiate works, exit if the config file is invalid
 func NewConfig(configFile string) *Config {
-	config := parseJson(configFile)
-	config.FilePath = configFile
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		log.Fatalf("Failed to load config file: %s", err)
+		os.Exit(1)
+	}
+	return config
+}
 
-	if config.QueryLogFile != "" {
-		querylog.SetQueryLogFile(config.QueryLogFile)
+// LoadConfig is NewConfig returning an error instead of exiting if the config file is invalid, so
+// the running config is kept on reload. It has no effect outside the returned config except a cache,
+// which must be discarded if the config is not used. Query log, stats and dnstap are changed by
+// SetOutputs, and subscriptions are downloaded by the caller.
+func LoadConfig(configFile string) (*Config, error) {
+	config, err := parseFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	config.FilePath = configFile
+	if err := config.validate(); err != nil {
+		return nil, err
 	}
+	config.initSubscriptions()
 
 	config.DomainTTLMap = getDomainTTLMap(config.DomainTTLFile)
 
-	config.DomainPrimaryList = initDomainMatcher(config.DomainFile.Primary, config.DomainFile.PrimaryMatcher, config.DomainFile.Matcher)
-	config.DomainAlternativeList = initDomainMatcher(config.DomainFile.Alternative, config.DomainFile.AlternativeMatcher, config.DomainFile.Matcher)
+	if len(config.TLSBindAddress) > 0 || len(config.QUICBindAddress) > 0 || len(config.DoH.HTTPSBindAddress) > 0 {
+		config.TLSConfig = getTLSConfig(config.TLSCertificate.CertFile, config.TLSCertificate.KeyFile)
+	}
+	config.DoHTrustedProxySet = getIPNetworkSetFromList(config.DoH.TrustedProxy)
+
+	if config.DebugHTTP.CertFile != "" {
+		config.DebugHTTPTLSConfig = getTLSConfig(config.DebugHTTP.CertFile, config.DebugHTTP.KeyFile)
+		if config.DebugHTTPTLSConfig == nil {
+			// Do not fall back to plain HTTP, which would expose the credentials
+			log.Errorf("Debug HTTP server is disabled because its TLS certificate is not loaded")
+			config.DebugHTTPAddress = ""
+		}
+	}
+	config.DebugHTTPAllowedSet = getIPNetworkSetFromList(config.DebugHTTP.AllowedIP)
+
+	config.initLegacyLists()
 
-	config.IPNetworkPrimarySet = getIPNetworkSet(config.IPNetworkFile.Primary)
-	config.IPNetworkAlternativeSet = getIPNetworkSet(config.IPNetworkFile.Alternative)
+	config.initUpstreamGroups()
+	config.ruleDefinitions = config.Rules
+	config.initRules()
+	if len(config.UpstreamGroups) == 0 {
+		return nil, &errors.NormalError{Message: "no upstream DNS is configured"}
+	}
+	if len(config.Rules) == 0 {
+		return nil, &errors.NormalError{Message: "no valid rule is configured"}
+	}
 
 	config.BlockDomainList = initDomainMatcher(config.BlockFile.DomainFile, config.BlockFile.Matcher, config.BlockFile.Matcher)
 	config.BlockIPList = getIPNetworkSet(config.BlockFile.IPFile)
@@ -125,10 +244,30 @@ func NewConfig(configFile string) *Config {
 	} else {
 		log.Info("Minimum TTL is disabled")
 	}
+	if config.MaximumTTL > 0 {
+		log.Infof("Maximum TTL has been set to %d", config.MaximumTTL)
+	}
 
-	config.Cache = cache.New(config.CacheSize)
+	config.Cache = cache.New(config.CacheSize, config.CacheMaxBytes, time.Duration(config.ServeStale.StaleWindow)*time.Second)
 	if config.CacheSize > 0 {
 		log.Infof("CacheSize is %d", config.CacheSize)
+		if config.CacheMaxBytes > 0 {
+			log.Infof("CacheMaxBytes is %d", config.CacheMaxBytes)
+		}
+		if config.ServeStale.StaleWindow > 0 {
+			log.Infof("Serve stale answers expired in %d seconds", config.ServeStale.StaleWindow)
+		}
+		if config.MaximumNegativeTTL > 0 {
+			config.Cache.SetMaximumNegativeTTL(uint32(config.MaximumNegativeTTL))
+		}
+		if config.CacheFile != "" {
+			config.Cache.SetPersistence(config.CacheFile, time.Duration(config.CacheSaveInterval)*time.Second)
+			log.Infof("Cache is saved to %s", config.CacheFile)
+		}
+		if config.Prefetch.TTLPercent > 0 {
+			config.Cache.SetPrefetch(config.Prefetch.TTLPercent, config.Prefetch.MinHits)
+			log.Infof("Prefetch records hit %d times when TTL is under %d%%", config.Prefetch.MinHits, config.Prefetch.TTLPercent)
+		}
 	} else {
 		log.Info("Cache is disabled")
 	}
@@ -141,24 +280,285 @@ func NewConfig(configFile string) *Config {
 		log.Info("Hosts file has been loaded successfully")
 	}
 
-	return config
+	return config, nil
 }
 
-func parseJson(path string) *Config {
+// SetOutputs applies the query log, stats and dnstap settings of c, which are shared by the whole
+// process. It is called once c is in use, so a config rejected on reload changes none of them.
+func (c *Config) SetOutputs() {
+	if c.QueryLogFile != "" {
+		options := querylog.RotateOptions{
+			MaxSize:    int64(c.QueryLogRotate.MaxSize) * 1024 * 1024,
+			Interval:   time.Duration(c.QueryLogRotate.Interval) * time.Hour,
+			MaxBackups: c.QueryLogRotate.MaxBackups,
+			Compress:   c.QueryLogRotate.Compress,
+		}
+		if err := querylog.SetQueryLogFile(c.QueryLogFile, options); err != nil {
+			log.Errorf("Failed to open query log file: %s", err)
+		}
+	}
+	querylog.SetFormat(c.QueryLogFormat)
+	stats.Default().SetWindow(c.StatsWindow)
+
+	if err := dnstap.SetOutput(c.Dnstap.Network, c.Dnstap.Address, c.Dnstap.Identity, c.Dnstap.BufferSize); err != nil {
+		log.Errorf("Failed to set dnstap output: %s", err)
+	}
+}
+
+// initSubscriptions replaces URLs of rule files with their copies on disk. Nothing is downloaded here,
+// copies are downloaded and updated by the caller later, a URL without a copy is downloaded first.
+func (c *Config) initSubscriptions() {
+	if c.Subscription.CacheDir == "" {
+		c.Subscription.CacheDir = "./subscription"
+	}
+	if c.Subscription.Interval <= 0 {
+		c.Subscription.Interval = 86400
+	}
+	if c.Subscription.Timeout <= 0 {
+		c.Subscription.Timeout = 30
+	}
+	c.SubscriptionClient = subscription.NewClient(c.Subscription.SOCKS5Address, time.Duration(c.Subscription.Timeout)*time.Second)
+
+	subscriptions := map[string]*subscription.Subscription{}
+	add := func(file *string, component string) {
+		if !subscription.IsURL(*file) {
+			return
+		}
+		s, ok := subscriptions[*file]
+		if !ok {
+			s = &subscription.Subscription{
+				URL:      *file,
+				Checksum: c.Subscription.Checksum[*file],
+				File:     subscription.CacheFile(c.Subscription.CacheDir, *file),
+				Interval: time.Duration(c.Subscription.Interval) * time.Second,
+			}
+			if interval := c.Subscription.Intervals[*file]; interval > 0 {
+				s.Interval = time.Duration(interval) * time.Second
+			}
+			subscriptions[*file] = s
+			c.Subscriptions = append(c.Subscriptions, s)
+			if s.LastUpdate().IsZero() {
+				log.Infof("%s is not downloaded yet, its rules are empty until it is downloaded", s.URL)
+			}
+		}
+		s.Components = append(s.Components, component)
+		*file = s.File
+	}
+
+	add(&c.DomainFile.Primary, "rules")
+	add(&c.DomainFile.Alternative, "rules")
+	add(&c.IPNetworkFile.Primary, "rules")
+	add(&c.IPNetworkFile.Alternative, "rules")
+	for _, r := range c.Rules {
+		add(&r.DomainFile, "rules")
+		add(&r.IPNetworkFile, "rules")
+	}
+	add(&c.HostsFile.HostsFile, "hosts")
+	add(&c.BlockFile.DomainFile, "block-domain")
+	add(&c.BlockFile.IPFile, "block-ip")
+}
+
+// initUpstreamGroups adds PrimaryDNS and AlternativeDNS as groups "Primary" and "Alternative"
+func (c *Config) initUpstreamGroups() {
+	legacy := map[string]*common.UpstreamGroup{
+		"Primary":     {Name: "Primary", Strategy: c.UpstreamStrategy.Primary, DNS: c.PrimaryDNS},
+		"Alternative": {Name: "Alternative", Strategy: c.UpstreamStrategy.Alternative, DNS: c.AlternativeDNS},
+	}
+	for _, g := range c.UpstreamGroups {
+		delete(legacy, g.Name)
+	}
+	for _, name := range []string{"Primary", "Alternative"} {
+		if g, ok := legacy[name]; ok && len(g.DNS) > 0 {
+			c.UpstreamGroups = append(c.UpstreamGroups, g)
+		}
+	}
+}
+
+func (c *Config) hasUpstreamGroup(name string) bool {
+	for _, g := range c.UpstreamGroups {
+		if g.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// initLegacyLists loads DomainFile and IPNetworkFile for PrimaryDNS and AlternativeDNS
+func (c *Config) initLegacyLists() {
+	c.DomainPrimaryList = initDomainMatcher(c.DomainFile.Primary, c.DomainFile.PrimaryMatcher, c.DomainFile.Matcher)
+	c.DomainAlternativeList = initDomainMatcher(c.DomainFile.Alternative, c.DomainFile.AlternativeMatcher, c.DomainFile.Matcher)
+
+	c.IPNetworkPrimarySet = getIPNetworkSet(c.IPNetworkFile.Primary)
+	c.IPNetworkAlternativeSet = getIPNetworkSet(c.IPNetworkFile.Alternative)
+}
+
+// ReloadRules loads domain and IP network files of rules again, and replaces Rules with new ones
+func (c *Config) ReloadRules() {
+	c.initLegacyLists()
+	c.initRules()
+}
+
+// ReloadDomainTTLMap loads DomainTTLFile again, and replaces DomainTTLMap with a new one
+func (c *Config) ReloadDomainTTLMap() {
+	c.DomainTTLMap = getDomainTTLMap(c.DomainTTLFile)
+}
+
+// initRules builds Rules from the rules in config file, rules in use are not changed
+func (c *Config) initRules() {
+	if len(c.ruleDefinitions) == 0 {
+		c.Rules = c.getLegacyRules()
+		return
+	}
+
+	rules := make([]*common.Rule, 0, len(c.ruleDefinitions))
+	for i, def := range c.ruleDefinitions {
+		r := new(common.Rule)
+		*r = *def
+		invalid := false
+		for _, name := range []string{r.Group, r.AnswerFrom, r.ConcurrentGroup} {
+			if name != "" && !c.hasUpstreamGroup(name) {
+				log.Errorf("Rule %d refers to upstream group %s which does not exist, ignored", i, name)
+				invalid = true
+			}
+		}
+		if r.Group == "" {
+			log.Errorf("Rule %d has no upstream group, ignored", i)
+			invalid = true
+		}
+		if invalid {
+			continue
+		}
+
+		if len(r.Domain) > 0 || r.DomainFile != "" {
+			r.DomainList = initDomainMatcher(r.DomainFile, r.Matcher, c.DomainFile.Matcher)
+			if r.DomainList == nil {
+				// Failed to load, match nothing rather than everything
+				r.DomainList = getDomainMatcher("full-map")
+			}
+			for _, d := range r.Domain {
+				_ = r.DomainList.Insert(d)
+			}
+		}
+		r.ClientSubnetSet = getIPNetworkSetFromList(r.ClientSubnet)
+		if len(r.IPNetwork) > 0 || r.IPNetworkFile != "" {
+			var ipNetList []*net.IPNet
+			if r.IPNetworkFile != "" {
+				ipNetList = getIPNetworkList(r.IPNetworkFile)
+			}
+			r.IPNetworkSet = common.NewIPSet(append(ipNetList, parseIPNetworkList(r.IPNetwork)...))
+		}
+		rules = append(rules, r)
+	}
+	c.Rules = rules
+}
+
+// getLegacyRules expresses the behaviour of PrimaryDNS and AlternativeDNS as rules.
+func (c *Config) getLegacyRules() []*common.Rule {
+	if !c.hasUpstreamGroup("Primary") && !c.hasUpstreamGroup("Alternative") {
+		if len(c.UpstreamGroups) > 0 {
+			return []*common.Rule{{Group: c.UpstreamGroups[0].Name}}
+		}
+		return nil
+	}
+
+	if c.OnlyPrimaryDNS || !c.hasUpstreamGroup("Alternative") {
+		return []*common.Rule{{Group: "Primary"}}
+	}
+	if !c.hasUpstreamGroup("Primary") {
+		return []*common.Rule{{Group: "Alternative"}}
+	}
+
+	var rules []*common.Rule
+	if c.DomainPrimaryList != nil {
+		rules = append(rules, &common.Rule{Group: "Primary", DomainList: c.DomainPrimaryList})
+	}
+	if c.IPv6UseAlternativeDNS {
+		rules = append(rules, &common.Rule{Group: "Alternative", QType: []uint16{dns.TypeAAAA}})
+	}
+	if c.DomainAlternativeList != nil {
+		rules = append(rules, &common.Rule{Group: "Alternative", DomainList: c.DomainAlternativeList})
+	}
+
+	primaryIPNetworkSet := c.IPNetworkPrimarySet
+	if primaryIPNetworkSet == nil {
+		primaryIPNetworkSet = common.NewIPSet(nil)
+	}
+	alternativeIPNetworkSet := c.IPNetworkAlternativeSet
+	if alternativeIPNetworkSet == nil {
+		alternativeIPNetworkSet = common.NewIPSet(nil)
+	}
+
+	whenAnswerNone := "use"
+	if c.WhenPrimaryDNSAnswerNoneUse == "AlternativeDNS" {
+		whenAnswerNone = "next"
+	}
+	var concurrentGroup string
+	if c.AlternativeFirst {
+		if c.AlternativeDNSConcurrent {
+			concurrentGroup = "Primary"
+		}
+		// Use AlternativeDNS if its answer is in alternative IP network, or use PrimaryDNS if the answer is in
+		// primary IP network.
+		rules = append(rules,
+			&common.Rule{Group: "Alternative", IPNetworkSet: alternativeIPNetworkSet, ExceptIPNetworkSet: primaryIPNetworkSet, WhenAnswerNone: whenAnswerNone, ConcurrentGroup: concurrentGroup},
+			&common.Rule{Group: "Primary", Tag: "AlternativeThenPrimary", AnswerFrom: "Alternative", IPNetworkSet: primaryIPNetworkSet},
+			&common.Rule{Group: "Alternative"})
+	} else {
+		if c.AlternativeDNSConcurrent {
+			concurrentGroup = "Alternative"
+		}
+		rules = append(rules,
+			&common.Rule{Group: "Primary", IPNetworkSet: primaryIPNetworkSet, ExceptIPNetworkSet: alternativeIPNetworkSet, WhenAnswerNone: whenAnswerNone, ConcurrentGroup: concurrentGroup},
+			&common.Rule{Group: "Alternative", Tag: "PrimaryThenAlternative"})
+	}
+	return rules
+}
+
+// parseFile parses config file in JSON, YAML or TOML
+func parseFile(path string) (*Config, error) {
 	b, err := ioutil.ReadFile(path)
 	if err != nil {
-		log.Fatalf("Failed to read config file: %s", err)
-		os.Exit(1)
+		return nil, &errors.NormalError{Message: "failed to read config file: " + err.Error()}
+	}
+	b, err = toJSON(b, formatOfConfigFile(path))
+	if err != nil {
+		return nil, &errors.NormalError{Message: "failed to parse config file: " + err.Error()}
 	}
 
 	j := new(Config)
-	err = json.Unmarshal(b, j)
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(j)
 	if err != nil {
-		log.Fatalf("Failed to parse config file: %s", err)
-		os.Exit(1)
+		return nil, &errors.NormalError{Message: "failed to parse config file: " + err.Error()}
 	}
 
-	return j
+	return j, nil
+}
+
+// validate returns an error if names of protocols, matchers, finders or strategies are not supported,
+// the same settings are reported by Check
+func (c *Config) validate() error {
+	ch := &checker{file: c.FilePath, found: map[string]int{}}
+	ch.checkSettings(c)
+	if len(ch.problems) == 0 {
+		return nil
+	}
+	messages := make([]string, len(ch.problems))
+	for i, p := range ch.problems {
+		messages[i] = p.Message
+	}
+	return &errors.NormalError{Message: strings.Join(messages, "; ")}
+}
+
+func getTLSConfig(certFile string, keyFile string) *tls.Config {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		log.Errorf("Failed to load TLS certificate %s: %s", certFile, err)
+		return nil
+	}
+	log.Infof("TLS certificate %s has been loaded successfully", certFile)
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
 }
 
 func getDomainTTLMap(file string) map[string]uint32 {
@@ -227,36 +627,40 @@ func getDomainTTLMap(file string) map[string]uint32 {
 	return dtl
 }
 
+// domainMatchers creates the matcher of each supported name
+var domainMatchers = map[string]func() matcher.Matcher{
+	"suffix-tree": func() matcher.Matcher { return matchersuffix.DefaultDomainTree() },
+	"full-map":    func() matcher.Matcher { return &matcherfull.Map{DataMap: make(map[string]struct{}, 100)} },
+	"full-list":   func() matcher.Matcher { return &matcherfull.List{} },
+	"regex-list":  func() matcher.Matcher { return &matcherregex.List{} },
+	"mix-list":    func() matcher.Matcher { return &matchermix.List{} },
+	"final":       func() matcher.Matcher { return &matcherfinal.Default{} },
+}
+
+// finders creates the finder of each supported name
+var finders = map[string]func() finder.Finder{
+	"regex-list": func() finder.Finder { return &finderregex.List{RegexMap: make(map[string][]string, 100)} },
+	"full-map":   func() finder.Finder { return &finderfull.Map{DataMap: make(map[string][]string, 100)} },
+}
+
 func getDomainMatcher(name string) (m matcher.Matcher) {
-	switch name {
-	case "suffix-tree":
-		return matchersuffix.DefaultDomainTree()
-	case "full-map":
-		return &matcherfull.Map{DataMap: make(map[string]struct{}, 100)}
-	case "full-list":
-		return &matcherfull.List{}
-	case "regex-list":
-		return &matcherregex.List{}
-	case "mix-list":
-		return &matchermix.List{}
-	case "final":
-		return &matcherfinal.Default{}
-	default:
+	newMatcher, ok := domainMatchers[name]
+	if !ok {
 		log.Warnf("Matcher %s does not exist, using full-map matcher as default", name)
-		return &matcherfull.Map{DataMap: make(map[string]struct{}, 100)}
+		newMatcher = domainMatchers["full-map"]
 	}
+	return newMatcher()
 }
 
 func getFinder(name string) (f finder.Finder) {
-	switch name {
-	case "regex-list":
-		return &finderregex.List{RegexMap: make(map[string][]string, 100)}
-	case "full-map":
-		return &finderfull.Map{DataMap: make(map[string][]string, 100)}
-	default:
-		log.Warnf("Finder %s does not exist, using full-map finder as default", name)
-		return &finderfull.Map{DataMap: make(map[string][]string, 100)}
+	newFinder, ok := finders[name]
+	if !ok {
+		if name != "" {
+			log.Warnf("Finder %s does not exist, using full-map finder as default", name)
+		}
+		newFinder = finders["full-map"]
 	}
+	return newFinder()
 }
 
 func initDomainMatcher(file string, name string, defaultName string) (m matcher.Matcher) {
@@ -305,7 +709,44 @@ func initDomainMatcher(file string, name string, defaultName string) (m matcher.
 	return
 }
 
+// getIPNetworkSetFromList accepts both CIDRs and single IP addresses
+func getIPNetworkSetFromList(list []string) *common.IPSet {
+	if len(list) == 0 {
+		return nil
+	}
+	return common.NewIPSet(parseIPNetworkList(list))
+}
+
+func parseIPNetworkList(list []string) []*net.IPNet {
+	ipNetList := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			log.Errorf("Error parsing IP network CIDR %s: %s", s, err)
+			continue
+		}
+		ipNetList = append(ipNetList, ipNet)
+	}
+	return ipNetList
+}
+
 func getIPNetworkSet(file string) *common.IPSet {
+	ipNetList := getIPNetworkList(file)
+	if ipNetList == nil {
+		return nil
+	}
+	return common.NewIPSet(ipNetList)
+}
+
+// getIPNetworkList returns nil if failed to open the file
+func getIPNetworkList(file string) []*net.IPNet {
 	ipNetList := make([]*net.IPNet, 0)
 
 	f, err := os.Open(file)
@@ -353,5 +794,5 @@ func getIPNetworkSet(file string) *common.IPSet {
 		}
 	}
 
-	return common.NewIPSet(ipNetList)
+	return ipNetList
 }
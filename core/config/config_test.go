@@ -0,0 +1,39 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionIntervals(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.json")
+	content := `{
+  "PrimaryDNS": [{"Name": "a", "Address": "1.1.1.1:53", "Protocol": "udp", "EDNSClientSubnet": {"Policy": "disable"}}],
+  "BlockFile": {"DomainFile": "https://example.com/domain.txt", "IPFile": "https://example.com/ip.txt"},
+  "Subscription": {"Interval": 3600, "CacheDir": "` + filepath.ToSlash(dir) + `", "Intervals": {"https://example.com/ip.txt": 60}}
+}`
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := LoadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Cache.Close()
+
+	want := map[string]time.Duration{
+		"https://example.com/domain.txt": time.Hour,
+		"https://example.com/ip.txt":     time.Minute,
+	}
+	if len(c.Subscriptions) != len(want) {
+		t.Fatalf("got %d subscriptions, want %d", len(c.Subscriptions), len(want))
+	}
+	for _, s := range c.Subscriptions {
+		if s.Interval != want[s.URL] {
+			t.Errorf("interval of %s is %s, want %s", s.URL, s.Interval, want[s.URL])
+		}
+	}
+}
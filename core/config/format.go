@@ -0,0 +1,145 @@
+// Copyright (c) 2016 shawn1m. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	"github.com/shawn1m/overture/core/errors"
+)
+
+// Formats of config file. YAML and TOML use the same keys as JSON.
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+)
+
+var fileFormat string
+
+// SetFileFormat sets the format of config file, if it is empty the format is decided by file extension
+func SetFileFormat(format string) {
+	fileFormat = format
+}
+
+// FormatOf returns the format of file by its extension, JSON by default
+func FormatOf(file string) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".toml":
+		return FormatTOML
+	default:
+		return FormatJSON
+	}
+}
+
+func formatOfConfigFile(file string) string {
+	if fileFormat != "" {
+		return fileFormat
+	}
+	return FormatOf(file)
+}
+
+// toJSON translates a config in format to JSON, so every format is decoded into Config in the same way
+func toJSON(b []byte, format string) ([]byte, error) {
+	if format == FormatJSON {
+		return b, nil
+	}
+	v, err := decode(b, format)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// decode parses a config in format into maps, slices and values
+func decode(b []byte, format string) (v map[string]interface{}, err error) {
+	switch format {
+	case FormatJSON:
+		decoder := json.NewDecoder(bytes.NewReader(b))
+		decoder.UseNumber()
+		err = decoder.Decode(&v)
+	case FormatYAML:
+		err = yaml.Unmarshal(b, &v)
+	case FormatTOML:
+		err = toml.Unmarshal(b, &v)
+	default:
+		return nil, &errors.NormalError{Message: "unsupported config format: " + format}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return normalize(v).(map[string]interface{}), nil
+}
+
+// normalize turns JSON numbers into integers or floats and drops null values, which TOML has not
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if e == nil {
+				delete(v, k)
+				continue
+			}
+			v[k] = normalize(e)
+		}
+		if v == nil {
+			return map[string]interface{}{}
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = normalize(e)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return v
+}
+
+func encode(v map[string]interface{}, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	switch format {
+	case FormatJSON:
+		encoder := json.NewEncoder(&buf)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(v); err != nil {
+			return nil, err
+		}
+	case FormatYAML:
+		encoder := yaml.NewEncoder(&buf)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(v); err != nil {
+			return nil, err
+		}
+	case FormatTOML:
+		if err := toml.NewEncoder(&buf).Encode(v); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, &errors.NormalError{Message: "unsupported config format: " + format}
+	}
+	return buf.Bytes(), nil
+}
+
+// Convert translates a config from a format to another. Keys are sorted in the result, and comments
+// are dropped.
+func Convert(b []byte, from string, to string) ([]byte, error) {
+	v, err := decode(b, from)
+	if err != nil {
+		return nil, err
+	}
+	return encode(v, to)
+}
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestConvert(t *testing.T) {
+	b, err := os.ReadFile("../../config.sample.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := decode(b, FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, format := range []string{FormatYAML, FormatTOML} {
+		converted, err := Convert(b, FormatJSON, format)
+		if err != nil {
+			t.Fatalf("convert to %s: %s", format, err)
+		}
+		back, err := Convert(converted, format, FormatJSON)
+		if err != nil {
+			t.Fatalf("convert from %s: %s", format, err)
+		}
+		got, err := decode(back, FormatJSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("config is changed after converted to %s and back", format)
+		}
+	}
+}
+
+func TestParseFileFormat(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"config.json": `{"BindAddress": [":53"], "MinimumTTL": 60, "DoH": {"Path": "/dns-query"}}`,
+		"config.yml":  "BindAddress: [\":53\"]\nMinimumTTL: 60 # comment\nDoH:\n  Path: /dns-query\n",
+		"config.toml": "BindAddress = [\":53\"]\nMinimumTTL = 60\n[DoH]\nPath = \"/dns-query\"\n",
+	}
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		os.WriteFile(file, []byte(content), 0644)
+		c, err := parseFile(file)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if !reflect.DeepEqual(c.BindAddress, []string{":53"}) || c.MinimumTTL != 60 || c.DoH.Path != "/dns-query" {
+			t.Errorf("%s is parsed as %+v", name, c)
+		}
+	}
+
+	// The flag takes precedence over the extension
+	file := filepath.Join(dir, "config.conf")
+	os.WriteFile(file, []byte(files["config.yml"]), 0644)
+	SetFileFormat(FormatYAML)
+	defer SetFileFormat("")
+	if c, err := parseFile(file); err != nil || c.MinimumTTL != 60 {
+		t.Errorf("config.conf is not parsed as YAML: %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2016 shawn1m. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package config
+
+import (
+	"net"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/shawn1m/overture/core/common"
+	"github.com/shawn1m/overture/core/hosts"
+	"github.com/shawn1m/overture/core/matcher"
+	"github.com/shawn1m/overture/core/replace"
+)
+
+// The following functions build lists from lines in the format of their files, with the matcher or
+// finder set in config. They are used to rebuild a list after it is edited at runtime.
+
+// NewBlockDomainList builds a list in the format of BlockFile.DomainFile
+func (c *Config) NewBlockDomainList(lines []string) matcher.Matcher {
+	m := getDomainMatcher(c.BlockFile.Matcher)
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); line != "" {
+			_ = m.Insert(line)
+		}
+	}
+	return m
+}
+
+// NewBlockIPList builds a list in the format of BlockFile.IPFile
+func (c *Config) NewBlockIPList(lines []string) *common.IPSet {
+	ipNetList := make([]*net.IPNet, 0, len(lines))
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(line)
+		if err != nil {
+			log.Errorf("Error parsing IP network CIDR %s: %s", line, err)
+			continue
+		}
+		ipNetList = append(ipNetList, ipNet)
+	}
+	return common.NewIPSet(ipNetList)
+}
+
+// NewHosts builds hosts in the format of HostsFile.HostsFile
+func (c *Config) NewHosts(lines []string) *hosts.Hosts {
+	return hosts.NewFromLines(lines, getFinder(c.HostsFile.Finder))
+}
+
+// NewReplaceDomainList builds a list in the format of ReplaceFile.DomainFile
+func (c *Config) NewReplaceDomainList(lines []string) *replace.DomainReplace {
+	return replace.NewDomainReplaceFromLines(lines, getFinder(c.ReplaceFile.Finder))
+}
+
+// NewReplaceIPList builds a list in the format of ReplaceFile.IPFile
+func (c *Config) NewReplaceIPList(lines []string) *replace.IPReplace {
+	return replace.NewIPReplaceFromLines(lines)
+}
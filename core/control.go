@@ -8,11 +8,17 @@ package core
 import (
 	"io"
 	"net/http"
+	"os"
+	"reflect"
+	"sync"
 	"time"
 
 	"github.com/shawn1m/overture/core/config"
+	"github.com/shawn1m/overture/core/dnstap"
 	"github.com/shawn1m/overture/core/inbound"
+	"github.com/shawn1m/overture/core/metrics"
 	"github.com/shawn1m/overture/core/outbound"
+	"github.com/shawn1m/overture/core/querylog"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -24,56 +30,175 @@ var (
 // Initiate the server with config file
 func InitServer(configFilePath string) {
 	conf = config.NewConfig(configFilePath)
+	conf.SetOutputs()
+	loadCache()
 	Start()
 }
 
-func Start() {
+// loadCache restores cache from CacheFile
+func loadCache() {
+	if conf.Cache == nil || conf.CacheFile == "" {
+		return
+	}
+	if err := conf.Cache.Load(conf.CacheFile); err != nil && !os.IsNotExist(err) {
+		log.Warnf("Failed to load cache: %s", err)
+	}
+}
+
+// newDispatcher returns an initiated dispatcher of c
+func newDispatcher(c *config.Config) (outbound.Dispatcher, error) {
 	// New dispatcher without RemoteClientBundle, RemoteClientBundle must be initiated when server is running
 	dispatcher := outbound.Dispatcher{
-		PrimaryDNS:                  conf.PrimaryDNS,
-		AlternativeDNS:              conf.AlternativeDNS,
-		OnlyPrimaryDNS:              conf.OnlyPrimaryDNS,
-		WhenPrimaryDNSAnswerNoneUse: conf.WhenPrimaryDNSAnswerNoneUse,
-		IPNetworkPrimarySet:         conf.IPNetworkPrimarySet,
-		IPNetworkAlternativeSet:     conf.IPNetworkAlternativeSet,
-		DomainPrimaryList:           conf.DomainPrimaryList,
-		DomainAlternativeList:       conf.DomainAlternativeList,
-
-		RedirectIPv6Record:       conf.IPv6UseAlternativeDNS,
-		AlternativeDNSConcurrent: conf.AlternativeDNSConcurrent,
-		MinimumTTL:               conf.MinimumTTL,
-		DomainTTLMap:             conf.DomainTTLMap,
-
-		Hosts: conf.Hosts,
-		Cache: conf.Cache,
-
-		AlternativeFirst: conf.AlternativeFirst,
+		UpstreamGroups: c.UpstreamGroups,
+		Rules:          c.Rules,
+
+		MinimumTTL:   c.MinimumTTL,
+		MaximumTTL:   c.MaximumTTL,
+		DomainTTLMap: c.DomainTTLMap,
+
+		StaleClientTimeout: time.Duration(c.ServeStale.ClientTimeout) * time.Millisecond,
+
+		Hosts: c.Hosts,
+		Cache: c.Cache,
 	}
-	dispatcher.Init()
+	err := dispatcher.Init()
+	return dispatcher, err
+}
 
-	srv = inbound.NewServer(conf.BindAddress, conf.DebugHTTPAddress, dispatcher, conf.RejectQType, conf.BlockDomainList, conf.BlockIPList, conf.ReplaceDomainList, conf.ReplaceIPList)
+func Start() {
+	dispatcher, err := newDispatcher(conf)
+	if err != nil {
+		log.Fatalf("Failed to create dispatcher: %s", err)
+	}
+	metrics.SetCache(conf.Cache)
+
+	doh := &inbound.DoHConfig{
+		HTTPSBindAddress: conf.DoH.HTTPSBindAddress,
+		HTTPBindAddress:  conf.DoH.HTTPBindAddress,
+		Path:             conf.DoH.Path,
+		TrustedProxySet:  conf.DoHTrustedProxySet,
+	}
+
+	debugHTTP := &inbound.DebugHTTPConfig{
+		Address:      conf.DebugHTTPAddress,
+		TLSConfig:    conf.DebugHTTPTLSConfig,
+		Token:        conf.DebugHTTP.Token,
+		Username:     conf.DebugHTTP.Username,
+		Password:     conf.DebugHTTP.Password,
+		AllowedSet:   conf.DebugHTTPAllowedSet,
+		DisablePprof: conf.DebugHTTP.DisablePprof,
+	}
+
+	srv = inbound.NewServer(conf.BindAddress, conf.TLSBindAddress, conf.QUICBindAddress, conf.TLSConfig, doh, debugHTTP, dispatcher, conf.RejectQType, conf.BlockDomainList, conf.BlockIPList, conf.ReplaceDomainList, conf.ReplaceIPList)
 	srv.HTTPMux.HandleFunc("/reload", ReloadHandler)
+	srv.HTTPMux.HandleFunc("/admin/", AdminHandler)
+	adminLock.Lock()
+	initRuleLists()
+	adminLock.Unlock()
 
 	go srv.Run()
+	watchFiles()
+	startSubscriptions()
 }
 
 // Stop server
 func Stop() {
+	stopWatching()
+	stopSubscriptions()
 	srv.Stop()
+	conf.Cache.Close()
+	dnstap.Close()
 }
 
-// ReloadHandler is passed to http.Server for handle "/reload" request
+// ReopenQueryLog reopens query log file after it is moved by external tools
+func ReopenQueryLog() {
+	log.Info("Reopening query log file")
+	if err := querylog.Reopen(); err != nil {
+		log.Errorf("Failed to reopen query log file: %s", err)
+	}
+}
+
+// ReloadHandler is passed to http.Server for handle "/reload" request. Only POST with header
+// X-Overture-Admin is accepted, as the requests changing state of AdminHandler.
 func ReloadHandler(w http.ResponseWriter, r *http.Request) {
-	Reload()
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get(adminHeader) == "" {
+		http.Error(w, "header "+adminHeader+" is required", http.StatusForbidden)
+		return
+	}
+	if err := Reload(); err != nil {
+		http.Error(w, "Failed to reload: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 	io.WriteString(w, "Reloaded")
 }
 
-// Reload config and restart server
-func Reload() {
+var reloadLock sync.Mutex
+
+// Reload builds a new config and dispatcher and swaps them into the running server. Listeners are
+// kept, and queries being served finish with the old ones. If the config file is invalid, the running
+// config is kept and the error is returned. Cache is carried over if CacheSize is not changed.
+func Reload() error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
 	log.Infof("Reloading")
-	Stop()
-	// Have to wait seconds (may be waiting for server shutdown completly) or we will get json parse ERROR. Unknown reason.
-	time.Sleep(time.Second)
-	conf = config.NewConfig(conf.FilePath)
-	Start()
+	newConf, err := config.LoadConfig(conf.FilePath)
+	if err != nil {
+		log.Errorf("Failed to reload, keep running with the old config: %s", err)
+		return err
+	}
+	// Upstreams are created before anything is replaced, so the running ones are kept if it fails
+	dispatcher, err := newDispatcher(newConf)
+	if err != nil {
+		newConf.Cache.Discard()
+		log.Errorf("Failed to reload, keep running with the old config: %s", err)
+		return err
+	}
+	if !isListenerEqual(conf, newConf) {
+		log.Warn("Changes of listeners, TLS certificate and debug HTTP server take effect after restart")
+	}
+
+	// Edits by admin API must not be interleaved with the replacement
+	adminLock.Lock()
+	oldConf := conf
+	conf = newConf
+	if conf.Cache != nil && oldConf.Cache != nil && conf.CacheSize == oldConf.CacheSize {
+		conf.Cache.MoveFrom(oldConf.Cache)
+		log.Info("Cache has been carried over")
+	} else {
+		oldConf.Cache.Close()
+		loadCache()
+	}
+
+	srv.SetLists(&inbound.Lists{
+		RejectQType:       conf.RejectQType,
+		BlockDomainList:   conf.BlockDomainList,
+		BlockIPList:       conf.BlockIPList,
+		ReplaceDomainList: conf.ReplaceDomainList,
+		ReplaceIPList:     conf.ReplaceIPList,
+	})
+	srv.SetDispatcher(dispatcher).Stop()
+	initRuleLists()
+	adminLock.Unlock()
+	conf.SetOutputs()
+	metrics.SetCache(conf.Cache)
+	watchFiles()
+	startSubscriptions()
+	log.Info("Reloaded")
+	return nil
+}
+
+// isListenerEqual returns false if settings which need restarting listeners are changed
+func isListenerEqual(a *config.Config, b *config.Config) bool {
+	return reflect.DeepEqual(a.BindAddress, b.BindAddress) &&
+		reflect.DeepEqual(a.TLSBindAddress, b.TLSBindAddress) &&
+		reflect.DeepEqual(a.QUICBindAddress, b.QUICBindAddress) &&
+		reflect.DeepEqual(a.TLSCertificate, b.TLSCertificate) &&
+		reflect.DeepEqual(a.DoH, b.DoH) &&
+		a.DebugHTTPAddress == b.DebugHTTPAddress &&
+		reflect.DeepEqual(a.DebugHTTP, b.DebugHTTP)
 }
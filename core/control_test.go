@@ -0,0 +1,97 @@
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testConfig = `{
+  "BindAddress": ["127.0.0.1:0"],
+  "PrimaryDNS": [{"Name": "Test", "Address": "127.0.0.1:53", "Protocol": "udp", "Timeout": 1}],
+  "OnlyPrimaryDNS": true,
+  "CacheSize": 10,
+  "RejectQType": %s
+}`
+
+func writeTestConfig(t *testing.T, file string, content string) {
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	writeTestConfig(t, file, fmt.Sprintf(testConfig, "[255]"))
+	InitServer(file)
+	defer Stop()
+
+	oldSrv, oldConf := srv, conf
+	oldDispatcher := srv.Dispatcher()
+
+	for _, content := range []string{"{", strings.Replace(fmt.Sprintf(testConfig, "[28]"), `"udp"`, `"udpp"`, 1)} {
+		writeTestConfig(t, file, content)
+		if err := Reload(); err == nil {
+			t.Error("reloading an invalid config should fail")
+		}
+		if conf != oldConf || srv.Dispatcher() != oldDispatcher {
+			t.Error("the running config should be kept if the new one is invalid")
+		}
+	}
+
+	// Outputs shared by the process are not changed by a rejected config
+	queryLogFile := filepath.Join(filepath.Dir(file), "query.log")
+	dnstapFile := filepath.Join(filepath.Dir(file), "dnstap.fstrm")
+	outputs := fmt.Sprintf(`,
+  "QueryLogFile": %q,
+  "Dnstap": {"Network": "file", "Address": %q}
+}`, filepath.ToSlash(queryLogFile), filepath.ToSlash(dnstapFile))
+	invalid := strings.Replace(fmt.Sprintf(testConfig, "[28]"), `"udp"`, `"udpp"`, 1)
+	writeTestConfig(t, file, strings.TrimSuffix(invalid, "\n}")+outputs)
+	if err := Reload(); err == nil {
+		t.Error("reloading a config with an invalid upstream should fail")
+	}
+	for _, f := range []string{queryLogFile, dnstapFile} {
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			t.Errorf("%s should not be opened by a rejected config: %v", f, err)
+		}
+	}
+
+	writeTestConfig(t, file, fmt.Sprintf(testConfig, "[28]"))
+	if err := Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if srv != oldSrv {
+		t.Error("server should not be restarted")
+	}
+	if srv.Dispatcher() == oldDispatcher || srv.Dispatcher().Cache != conf.Cache {
+		t.Error("dispatcher should be replaced")
+	}
+	if !reflect.DeepEqual(srv.Lists().RejectQType, []uint16{28}) {
+		t.Errorf("unexpected reject qtype %v", srv.Lists().RejectQType)
+	}
+	for _, r := range []struct {
+		method string
+		header bool
+		code   int
+	}{
+		{http.MethodGet, true, http.StatusMethodNotAllowed},
+		{http.MethodPost, false, http.StatusForbidden},
+		{http.MethodPost, true, http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(r.method, "/reload", nil)
+		if r.header {
+			req.Header.Set(adminHeader, "1")
+		}
+		ReloadHandler(w, req)
+		if w.Code != r.code {
+			t.Errorf("%s /reload with header %v: got %d, want %d", r.method, r.header, w.Code, r.code)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+// Copyright (c) 2016 shawn1m. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Package dnstap writes client and forwarder messages in dnstap format.
+package dnstap
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+)
+
+const defaultBufferSize = 10000
+
+var (
+	lock    sync.RWMutex
+	current *output
+)
+
+// output buffers frames, so a slow collector does not block resolution. Frames are dropped when
+// the buffer is full.
+type output struct {
+	out      tap.Output
+	buffer   chan []byte
+	done     chan struct{}
+	identity []byte
+	dropped  uint64
+}
+
+func (o *output) run() {
+	go o.out.RunOutputLoop()
+	ch := o.out.GetOutputChannel()
+	for b := range o.buffer {
+		ch <- b
+	}
+	o.out.Close()
+	close(o.done)
+}
+
+// SetOutput writes dnstap frames to address, network is "unix", "tcp" or "file". The previous output
+// is closed, and dnstap is disabled if address is empty.
+func SetOutput(network string, address string, identity string, bufferSize int) error {
+	var o *output
+	if address != "" {
+		var out tap.Output
+		var err error
+		switch network {
+		case "unix", "tcp":
+			var addr net.Addr
+			if network == "unix" {
+				addr, err = net.ResolveUnixAddr("unix", address)
+			} else {
+				addr, err = net.ResolveTCPAddr("tcp", address)
+			}
+			if err != nil {
+				return err
+			}
+			var sockOut *tap.FrameStreamSockOutput
+			sockOut, err = tap.NewFrameStreamSockOutput(addr)
+			if err == nil {
+				sockOut.SetTimeout(time.Second)
+				out = sockOut
+			}
+		case "file", "":
+			out, err = tap.NewFrameStreamOutputFromFilename(address)
+		default:
+			return net.UnknownNetworkError(network)
+		}
+		if err != nil {
+			return err
+		}
+
+		if identity == "" {
+			identity, _ = os.Hostname()
+		}
+		if bufferSize <= 0 {
+			bufferSize = defaultBufferSize
+		}
+		o = &output{out: out, buffer: make(chan []byte, bufferSize), done: make(chan struct{}), identity: []byte(identity)}
+		go o.run()
+		log.Infof("Dnstap output to %s:%s", network, address)
+	}
+
+	lock.Lock()
+	old := current
+	current = o
+	if old != nil {
+		close(old.buffer)
+	}
+	lock.Unlock()
+	return nil
+}
+
+// Close flushes and closes the output
+func Close() {
+	lock.Lock()
+	old := current
+	current = nil
+	if old != nil {
+		close(old.buffer)
+	}
+	lock.Unlock()
+	if old != nil {
+		<-old.done
+	}
+}
+
+// Enabled returns true if there is an output, messages should be built only if it is enabled
+func Enabled() bool {
+	lock.RLock()
+	defer lock.RUnlock()
+	return current != nil
+}
+
+// Dropped returns number of frames dropped because the buffer is full
+func Dropped() uint64 {
+	lock.RLock()
+	defer lock.RUnlock()
+	if current == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&current.dropped)
+}
+
+// ClientQuery writes a CLIENT_QUERY message, protocol is the network of the inbound server
+func ClientQuery(remote net.Addr, protocol string, q *dns.Msg, queryTime time.Time) {
+	m := newMessage(tap.Message_CLIENT_QUERY, protocol)
+	setQueryAddress(m, remote)
+	setQuery(m, q, queryTime)
+	send(m)
+}
+
+// ClientResponse writes a CLIENT_RESPONSE message
+func ClientResponse(remote net.Addr, protocol string, q *dns.Msg, resp *dns.Msg, queryTime time.Time) {
+	m := newMessage(tap.Message_CLIENT_RESPONSE, protocol)
+	setQueryAddress(m, remote)
+	setQuery(m, q, queryTime)
+	setResponse(m, resp, time.Now())
+	send(m)
+}
+
+// ForwarderQuery writes a FORWARDER_QUERY message, protocol and address are of the upstream
+func ForwarderQuery(protocol string, address string, q *dns.Msg, queryTime time.Time) {
+	m := newMessage(tap.Message_FORWARDER_QUERY, protocol)
+	setResponseAddress(m, address)
+	setQuery(m, q, queryTime)
+	send(m)
+}
+
+// ForwarderResponse writes a FORWARDER_RESPONSE message
+func ForwarderResponse(protocol string, address string, q *dns.Msg, resp *dns.Msg, queryTime time.Time) {
+	m := newMessage(tap.Message_FORWARDER_RESPONSE, protocol)
+	setResponseAddress(m, address)
+	setQuery(m, q, queryTime)
+	setResponse(m, resp, time.Now())
+	send(m)
+}
+
+func newMessage(t tap.Message_Type, protocol string) *tap.Message {
+	return &tap.Message{Type: &t, SocketProtocol: socketProtocol(protocol)}
+}
+
+func socketProtocol(protocol string) *tap.SocketProtocol {
+	var p tap.SocketProtocol
+	switch protocol {
+	case "tcp":
+		p = tap.SocketProtocol_TCP
+	case "tcp-tls", "tls":
+		p = tap.SocketProtocol_DOT
+	case "https":
+		p = tap.SocketProtocol_DOH
+	default:
+		// DNS-over-QUIC is not defined in this version of dnstap protocol, UDP is its transport
+		p = tap.SocketProtocol_UDP
+	}
+	return &p
+}
+
+func setQuery(m *tap.Message, q *dns.Msg, t time.Time) {
+	m.QueryMessage, _ = q.Pack()
+	sec, nsec := uint64(t.Unix()), uint32(t.Nanosecond())
+	m.QueryTimeSec, m.QueryTimeNsec = &sec, &nsec
+}
+
+func setResponse(m *tap.Message, resp *dns.Msg, t time.Time) {
+	m.ResponseMessage, _ = resp.Pack()
+	sec, nsec := uint64(t.Unix()), uint32(t.Nanosecond())
+	m.ResponseTimeSec, m.ResponseTimeNsec = &sec, &nsec
+}
+
+func setQueryAddress(m *tap.Message, addr net.Addr) {
+	if addr == nil {
+		return
+	}
+	ip, port := splitAddress(addr.String())
+	m.QueryAddress, m.QueryPort = ip, port
+	m.SocketFamily = socketFamily(ip)
+}
+
+func setResponseAddress(m *tap.Message, address string) {
+	ip, port := splitAddress(address)
+	m.ResponseAddress, m.ResponsePort = ip, port
+	m.SocketFamily = socketFamily(ip)
+}
+
+// splitAddress returns ip and port of "ip:port", or "host:port@ip" for TLS and QUIC upstreams.
+// The ip is nil if address is not an ip address, such as an URL.
+func splitAddress(address string) ([]byte, *uint32) {
+	var ipAddress string
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		ipAddress = address[i+1:]
+		address = address[:i]
+	}
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, nil
+	}
+	if ipAddress != "" {
+		host = ipAddress
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	var port *uint32
+	if p, err := strconv.ParseUint(portString, 10, 16); err == nil {
+		p32 := uint32(p)
+		port = &p32
+	}
+	return ip, port
+}
+
+func socketFamily(ip []byte) *tap.SocketFamily {
+	if ip == nil {
+		return nil
+	}
+	f := tap.SocketFamily_INET
+	if len(ip) == net.IPv6len {
+		f = tap.SocketFamily_INET6
+	}
+	return &f
+}
+
+func send(m *tap.Message) {
+	lock.RLock()
+	defer lock.RUnlock()
+	if current == nil {
+		return
+	}
+
+	t := tap.Dnstap_MESSAGE
+	version := []byte("overture")
+	b, err := proto.Marshal(&tap.Dnstap{Type: &t, Identity: current.identity, Version: version, Message: m})
+	if err != nil {
+		log.Debugf("Failed to marshal dnstap message: %s", err)
+		return
+	}
+	select {
+	case current.buffer <- b:
+	default:
+		atomic.AddUint64(&current.dropped, 1)
+	}
+}
@@ -0,0 +1,86 @@
+package dnstap
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	tap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestFileOutput(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dnstap.fstrm")
+	if err := SetOutput("file", file, "test", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(q)
+	now := time.Now()
+	client := &net.UDPAddr{IP: net.ParseIP("192.168.1.1"), Port: 5353}
+
+	ClientQuery(client, "udp", q, now)
+	ForwarderQuery("tcp-tls", "dns.google:853@8.8.8.8", q, now)
+	ForwarderResponse("tcp-tls", "dns.google:853@8.8.8.8", q, resp, now)
+	ClientResponse(client, "udp", q, resp, now)
+	Close()
+
+	input, err := tap.NewFrameStreamInputFromFilename(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan []byte, 10)
+	go func() {
+		input.ReadInto(ch)
+		close(ch)
+	}()
+
+	var types []tap.Message_Type
+	for b := range ch {
+		dt := new(tap.Dnstap)
+		if err := proto.Unmarshal(b, dt); err != nil {
+			t.Fatal(err)
+		}
+		if string(dt.Identity) != "test" {
+			t.Errorf("identity is %s", dt.Identity)
+		}
+		m := dt.Message
+		types = append(types, m.GetType())
+		switch m.GetType() {
+		case tap.Message_CLIENT_QUERY:
+			if !net.IP(m.QueryAddress).Equal(client.IP) || m.GetQueryPort() != 5353 || m.GetSocketProtocol() != tap.SocketProtocol_UDP {
+				t.Errorf("unexpected client query: %v", m)
+			}
+		case tap.Message_FORWARDER_RESPONSE:
+			if !net.IP(m.ResponseAddress).Equal(net.ParseIP("8.8.8.8")) || m.GetResponsePort() != 853 || m.GetSocketProtocol() != tap.SocketProtocol_DOT {
+				t.Errorf("unexpected forwarder response: %v", m)
+			}
+			r := new(dns.Msg)
+			if err := r.Unpack(m.ResponseMessage); err != nil || r.Id != q.Id {
+				t.Errorf("unexpected response message: %v", err)
+			}
+		}
+	}
+	want := []tap.Message_Type{tap.Message_CLIENT_QUERY, tap.Message_FORWARDER_QUERY, tap.Message_FORWARDER_RESPONSE, tap.Message_CLIENT_RESPONSE}
+	if len(types) != len(want) {
+		t.Fatalf("got messages %v, want %v", types, want)
+	}
+	for i := range want {
+		if types[i] != want[i] {
+			t.Errorf("message %d is %v, want %v", i, types[i], want[i])
+		}
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	if Enabled() {
+		t.Error("dnstap should be disabled by default")
+	}
+	// Should not panic without output
+	ClientQuery(nil, "udp", new(dns.Msg), time.Now())
+}
@@ -42,6 +42,17 @@ func New(path string, finder finder.Finder) (*Hosts, error) {
 	return h, nil
 }
 
+// NewFromLines returns hosts parsed from lines in the format of hosts file
+func NewFromLines(lines []string, finder finder.Finder) *Hosts {
+	h := &Hosts{finder: finder}
+	for _, line := range lines {
+		if err := h.parseLine(line); err != nil {
+			log.Warnf("Bad formatted hosts line: %s", err)
+		}
+	}
+	return h
+}
+
 func (h *Hosts) Find(name string) (ipv4List []net.IP, ipv6List []net.IP) {
 	name = strings.TrimSuffix(name, ".")
 	hostsLines := h.findHosts(name)
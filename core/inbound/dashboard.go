@@ -0,0 +1,33 @@
+package inbound
+
+import (
+	"embed"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"net/http"
+	"strconv"
+
+	"github.com/shawn1m/overture/core/querylog"
+)
+
+// Static files of the dashboard, embedded so it works without internet access
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+func dashboardHandler() http.Handler {
+	files, _ := fs.Sub(dashboardFiles, "dashboard")
+	return http.StripPrefix("/dashboard/", http.FileServer(http.FS(files)))
+}
+
+func (s *Server) DumpQueryLog(w http.ResponseWriter, req *http.Request) {
+	n, _ := strconv.Atoi(req.URL.Query().Get("n"))
+	responseBytes, err := json.Marshal(querylog.Tail(n))
+	if err != nil {
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	io.WriteString(w, string(responseBytes))
+}
@@ -0,0 +1,119 @@
+(function () {
+  "use strict";
+
+  var $ = function (id) { return document.getElementById(id); };
+  var paused = false;
+  var cache = {};
+
+  function get(path, done) {
+    var xhr = new XMLHttpRequest();
+    xhr.open("GET", path);
+    xhr.onload = function () {
+      if (xhr.status !== 200) return;
+      try { done(JSON.parse(xhr.responseText)); } catch (e) { /* not JSON, such as cache disabled */ }
+    };
+    xhr.send();
+  }
+
+  function row(cells, classes) {
+    var tr = document.createElement("tr");
+    cells.forEach(function (c, i) {
+      var td = document.createElement("td");
+      td.textContent = c === undefined || c === null ? "" : c;
+      if (classes && classes[i]) td.className = classes[i];
+      tr.appendChild(td);
+    });
+    return tr;
+  }
+
+  function fill(id, rows) {
+    var tbody = $(id);
+    var fragment = document.createDocumentFragment();
+    rows.forEach(function (r) { fragment.appendChild(r); });
+    tbody.textContent = "";
+    tbody.appendChild(fragment);
+  }
+
+  function counts(list) {
+    return (list || []).map(function (c) { return row([c.name, c.count]); });
+  }
+
+  function updateStats() {
+    get("../stats?top=10", function (s) {
+      var reasons = s.block_reasons || {};
+      $("window").textContent = "last " + s.window_hours + " hours";
+      $("queries").textContent = s.queries;
+      $("blocked").textContent = s.blocked;
+      $("blocked-domain").textContent = reasons.domain || 0;
+      $("blocked-ip").textContent = reasons.ip || 0;
+      $("blocked-qtype").textContent = reasons.qtype || 0;
+      fill("top-domains", counts(s.top_domains));
+      fill("top-blocked", counts(s.top_blocked_domains));
+      fill("top-clients", counts(s.top_clients));
+    });
+  }
+
+  function updateUpstreams() {
+    get("../upstream", function (groups) {
+      var rows = [];
+      Object.keys(groups).sort().forEach(function (g) {
+        groups[g].forEach(function (u) {
+          var rate = u.queries ? (100 * u.failures / u.queries).toFixed(1) + "%" : "-";
+          rows.push(row(
+            [g, u.name, u.address, u.available ? "up" : "down", u.latency_ms.toFixed(1), u.queries, u.failures, rate, u.last_error],
+            [null, null, null, u.available ? "good" : "bad"]));
+        });
+      });
+      fill("upstreams", rows);
+    });
+  }
+
+  function updateTail() {
+    get("../querylog?n=100", function (entries) {
+      fill("tail", entries.map(function (e) {
+        return row(
+          [new Date(e.time).toLocaleTimeString(), e.client_ip, e.name, e.type, e.tag, e.rcode,
+            e.upstream, e.latency_ms, (e.answers || []).join(" | "), e.rule],
+          [null, null, null, null, e.tag === "Block" ? "bad" : null, e.rcode === "NOERROR" ? null : "bad"]);
+      }));
+    });
+  }
+
+  function renderCache() {
+    var filter = $("cache-filter").value.toLowerCase();
+    var rows = [];
+    Object.keys(cache.body || {}).sort().forEach(function (key) {
+      if (filter && key.toLowerCase().indexOf(filter) < 0) return;
+      var answers = cache.body[key] || [];
+      if (answers.length === 0) rows.push(row([key]));
+      answers.forEach(function (a) {
+        rows.push(row([key, a.name, a.ttl, a.type, a.rdata]));
+      });
+    });
+    // Keep the page responsive with a large cache
+    fill("cache", rows.slice(0, 500));
+  }
+
+  function updateCache() {
+    get("../cache?nobody=false", function (c) {
+      cache = c;
+      $("cache-size").textContent = c.length + " / " + c.capacity;
+      renderCache();
+    });
+  }
+
+  function tick() {
+    if (paused) return;
+    updateStats();
+    updateUpstreams();
+    updateTail();
+  }
+
+  $("pause").addEventListener("change", function (e) { paused = e.target.checked; });
+  $("cache-filter").addEventListener("input", renderCache);
+
+  tick();
+  updateCache();
+  setInterval(tick, 2000);
+  setInterval(function () { if (!paused) updateCache(); }, 10000);
+})();
@@ -0,0 +1,23 @@
+package inbound
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDashboard(t *testing.T) {
+	h := dashboardHandler()
+	for path, want := range map[string]string{
+		"/dashboard/":          "<title>Overture</title>",
+		"/dashboard/app.js":    "querylog",
+		"/dashboard/style.css": "table",
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), want) {
+			t.Errorf("%s: status %d", path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package inbound
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/shawn1m/overture/core/common"
+)
+
+// DebugHTTPConfig holds the settings of the debug HTTP server. Requests are accepted if they carry
+// the bearer token or the basic auth credentials, when none of them is set no authentication is
+// required. Basic auth needs both Username and Password, a half set pair rejects every request.
+type DebugHTTPConfig struct {
+	Address      string
+	TLSConfig    *tls.Config
+	Token        string
+	Username     string
+	Password     string
+	AllowedSet   *common.IPSet
+	DisablePprof bool
+}
+
+// handler wraps next with the IP allowlist and authentication
+func (c *DebugHTTPConfig) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !c.isAllowed(req) {
+			log.Warnf("Debug HTTP request from %s is not allowed", req.RemoteAddr)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		if !c.isAuthorized(req) {
+			if c.Username != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="overture"`)
+			}
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func (c *DebugHTTPConfig) isAllowed(req *http.Request) bool {
+	if c.AllowedSet == nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && c.AllowedSet.Contains(ip, false, "")
+}
+
+func (c *DebugHTTPConfig) isAuthorized(req *http.Request) bool {
+	if c.Token == "" && c.Username == "" && c.Password == "" {
+		return true
+	}
+	if c.Token != "" {
+		auth := req.Header.Get("Authorization")
+		if strings.HasPrefix(auth, "Bearer ") && secureEqual(strings.TrimPrefix(auth, "Bearer "), c.Token) {
+			return true
+		}
+	}
+	if c.Username != "" && c.Password != "" {
+		username, password, ok := req.BasicAuth()
+		// Compare both to take the same time whichever is wrong
+		usernameOK := secureEqual(username, c.Username)
+		passwordOK := secureEqual(password, c.Password)
+		if ok && usernameOK && passwordOK {
+			return true
+		}
+	}
+	return false
+}
+
+func secureEqual(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -0,0 +1,63 @@
+package inbound
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/shawn1m/overture/core/common"
+)
+
+func TestDebugHTTPHandler(t *testing.T) {
+	_, allowed, _ := net.ParseCIDR("10.0.0.0/8")
+	c := &DebugHTTPConfig{
+		Token:      "secret",
+		Username:   "admin",
+		Password:   "pass",
+		AllowedSet: common.NewIPSet([]*net.IPNet{allowed}),
+	}
+	h := c.handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+
+	cases := []struct {
+		remoteAddr string
+		setAuth    func(req *http.Request)
+		want       int
+	}{
+		{"192.168.1.1:1234", func(req *http.Request) { req.Header.Set("Authorization", "Bearer secret") }, http.StatusForbidden},
+		{"10.0.0.1:1234", func(req *http.Request) {}, http.StatusUnauthorized},
+		{"10.0.0.1:1234", func(req *http.Request) { req.Header.Set("Authorization", "Bearer wrong") }, http.StatusUnauthorized},
+		{"10.0.0.1:1234", func(req *http.Request) { req.SetBasicAuth("admin", "wrong") }, http.StatusUnauthorized},
+		{"10.0.0.1:1234", func(req *http.Request) { req.Header.Set("Authorization", "Bearer secret") }, http.StatusOK},
+		{"10.0.0.1:1234", func(req *http.Request) { req.SetBasicAuth("admin", "pass") }, http.StatusOK},
+	}
+	for i, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/cache", nil)
+		req.RemoteAddr = c.remoteAddr
+		c.setAuth(req)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != c.want {
+			t.Errorf("case %d: status %d, want %d", i, w.Code, c.want)
+		}
+	}
+
+	open := (&DebugHTTPConfig{}).handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	w := httptest.NewRecorder()
+	open.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/cache", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("no authentication is required by default, got %d", w.Code)
+	}
+
+	// Half set credentials must not disable authentication or accept an empty password
+	for _, c := range []*DebugHTTPConfig{{Password: "pass"}, {Username: "admin"}} {
+		h := c.handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+		req := httptest.NewRequest(http.MethodGet, "/cache", nil)
+		req.SetBasicAuth(c.Username, c.Password)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("username %q password %q: status %d, want %d", c.Username, c.Password, w.Code, http.StatusUnauthorized)
+		}
+	}
+}
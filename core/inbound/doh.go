@@ -0,0 +1,157 @@
+package inbound
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/shawn1m/overture/core/common"
+)
+
+const dohMediaType = "application/dns-message"
+
+// dohHandler implements DNS-over-HTTPS (RFC 8484) and feeds the queries into Server.ServeDNS.
+type dohHandler struct {
+	server         *Server
+	path           string
+	trustedProxies *common.IPSet
+}
+
+func (h *dohHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != h.path {
+		http.NotFound(w, req)
+		return
+	}
+
+	var buf []byte
+	var err error
+	switch req.Method {
+	case http.MethodGet:
+		buf, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+		if err != nil || len(buf) == 0 {
+			http.Error(w, "invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if req.Header.Get("Content-Type") != dohMediaType {
+			http.Error(w, "unsupported media type", http.StatusUnsupportedMediaType)
+			return
+		}
+		buf, err = ioutil.ReadAll(http.MaxBytesReader(w, req.Body, dns.MaxMsgSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := new(dns.Msg)
+	if err := q.Unpack(buf); err != nil || len(q.Question) == 0 {
+		http.Error(w, "invalid dns message", http.StatusBadRequest)
+		return
+	}
+
+	rw := &dohResponseWriter{remoteAddr: &net.TCPAddr{IP: h.clientIP(req)}, localAddr: req.Context().Value(http.LocalAddrContextKey)}
+	h.server.ServeDNS(rw, q)
+	if rw.msg == nil {
+		http.Error(w, "no response", http.StatusInternalServerError)
+		return
+	}
+
+	b, err := rw.msg.Pack()
+	if err != nil {
+		log.Warnf("Pack DoH response failed: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", dohMediaType)
+	w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(minTTL(rw.msg))))
+	w.Write(b)
+}
+
+// clientIP returns the address of the real client, X-Forwarded-For is only honoured when the
+// request comes from a trusted proxy.
+func (h *dohHandler) clientIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || h.trustedProxies == nil || !h.trustedProxies.Contains(ip, false, "") {
+		return ip
+	}
+
+	var hops []string
+	for _, v := range req.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	// Walk backwards, the first hop that is not a trusted proxy is the client.
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !h.trustedProxies.Contains(hop, false, "") {
+			break
+		}
+	}
+	return ip
+}
+
+func minTTL(m *dns.Msg) uint32 {
+	var ttl uint32
+	first := true
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range rrs {
+			if first || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				first = false
+			}
+		}
+	}
+	return ttl
+}
+
+// dohResponseWriter implements dns.ResponseWriter for a single DoH request.
+type dohResponseWriter struct {
+	remoteAddr net.Addr
+	localAddr  interface{}
+	msg        *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr {
+	if a, ok := w.localAddr.(net.Addr); ok {
+		return a
+	}
+	return &net.TCPAddr{}
+}
+
+func (w *dohResponseWriter) RemoteAddr() net.Addr { return w.remoteAddr }
+
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+
+func (w *dohResponseWriter) Close() error        { return nil }
+func (w *dohResponseWriter) TsigStatus() error   { return nil }
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+func (w *dohResponseWriter) Hijack()             {}
@@ -0,0 +1,40 @@
+package inbound
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/shawn1m/overture/core/common"
+)
+
+func TestDoHClientIP(t *testing.T) {
+	_, ipNet, _ := net.ParseCIDR("10.0.0.0/8")
+	h := &dohHandler{trustedProxies: common.NewIPSet([]*net.IPNet{ipNet})}
+
+	var tests = []struct {
+		remoteAddr string
+		xff        string
+		want       string
+	}{
+		{"1.2.3.4:5678", "", "1.2.3.4"},
+		{"1.2.3.4:5678", "8.8.8.8", "1.2.3.4"},
+		{"10.0.0.1:5678", "", "10.0.0.1"},
+		{"10.0.0.1:5678", "8.8.8.8", "8.8.8.8"},
+		{"10.0.0.1:5678", "9.9.9.9, 8.8.8.8, 10.0.0.2", "8.8.8.8"},
+		{"10.0.0.1:5678", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		{"10.0.0.1:5678", "invalid, 8.8.8.8", "8.8.8.8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.remoteAddr+" "+tt.xff, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/dns-query", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if got := h.clientIP(req).String(); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package inbound
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// DoQ error codes, see RFC 9250 section 4.3
+const (
+	doqNoError       = 0x0
+	doqInternalError = 0x1
+	doqProtocolError = 0x2
+)
+
+const quicIdleTimeout = 30 * time.Second
+
+// Manual create listener inorder to have a way to close it.
+func (s *Server) listenQUIC(addr string, handler dns.Handler, wg *sync.WaitGroup) {
+	tlsConfig := s.tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{"doq"}
+	ln, err := quic.ListenAddr(addr, tlsConfig, &quic.Config{MaxIdleTimeout: quicIdleTimeout})
+	if err != nil {
+		log.Fatalf("Listening on port %s failed: %s", "quic", err)
+		os.Exit(1)
+	}
+
+	wg.Add(1)
+	go func() {
+		go func() {
+			<-s.ctx.Done()
+			log.Warnf("Shutting down the server on protocol %s", "quic")
+			ln.Close()
+		}()
+		for {
+			conn, err := ln.Accept(s.ctx)
+			if err != nil {
+				if s.ctx.Err() == nil {
+					log.Errorf("Accept quic connection failed: %s", err)
+				}
+				break
+			}
+			go serveQUICConn(conn, handler)
+		}
+		wg.Done()
+	}()
+}
+
+func serveQUICConn(conn *quic.Conn, handler dns.Handler) {
+	for {
+		// AcceptStream returns an error once the connection is closed or idle timeout reached.
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go serveQUICStream(conn, stream, handler)
+	}
+}
+
+func serveQUICStream(conn *quic.Conn, stream *quic.Stream, handler dns.Handler) {
+	stream.SetReadDeadline(time.Now().Add(quicIdleTimeout))
+
+	var l uint16
+	if err := binary.Read(stream, binary.BigEndian, &l); err != nil {
+		stream.CancelRead(doqProtocolError)
+		stream.CancelWrite(doqProtocolError)
+		return
+	}
+	buf := make([]byte, l)
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		stream.CancelRead(doqProtocolError)
+		stream.CancelWrite(doqProtocolError)
+		return
+	}
+
+	q := new(dns.Msg)
+	// The message ID must be set to 0 over QUIC, otherwise it is a protocol error.
+	if err := q.Unpack(buf); err != nil || q.Id != 0 || len(q.Question) == 0 {
+		conn.CloseWithError(doqProtocolError, "invalid query")
+		return
+	}
+
+	w := &quicResponseWriter{conn: conn, stream: stream}
+	handler.ServeDNS(w, q)
+	if !w.written {
+		stream.CancelWrite(doqInternalError)
+	}
+}
+
+// quicAddr reports "quic" as network, so responses will not be truncated as for udp.
+type quicAddr struct {
+	net.Addr
+}
+
+func (a *quicAddr) Network() string { return "quic" }
+
+// quicResponseWriter implements dns.ResponseWriter for a single DoQ stream.
+type quicResponseWriter struct {
+	conn    *quic.Conn
+	stream  *quic.Stream
+	written bool
+}
+
+func (w *quicResponseWriter) LocalAddr() net.Addr  { return &quicAddr{w.conn.LocalAddr()} }
+func (w *quicResponseWriter) RemoteAddr() net.Addr { return &quicAddr{w.conn.RemoteAddr()} }
+
+func (w *quicResponseWriter) WriteMsg(m *dns.Msg) error {
+	b, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func (w *quicResponseWriter) Write(b []byte) (int, error) {
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+	w.written = true
+	if _, err := w.stream.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), w.stream.Close()
+}
+
+func (w *quicResponseWriter) Close() error        { return w.stream.Close() }
+func (w *quicResponseWriter) TsigStatus() error   { return nil }
+func (w *quicResponseWriter) TsigTimersOnly(bool) {}
+func (w *quicResponseWriter) Hijack()             {}
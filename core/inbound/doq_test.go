@@ -0,0 +1,85 @@
+package inbound
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+
+	"github.com/shawn1m/overture/core/internal/testcert"
+)
+
+func TestDoQ(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+
+	cert, _ := testcert.Generate(t)
+	s := &Server{tlsConfig: &tls.Config{Certificates: []tls.Certificate{cert}}}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	wg := new(sync.WaitGroup)
+	s.listenQUIC(addr, dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		if w.RemoteAddr().Network() != "quic" {
+			t.Errorf("got network %s, want quic", w.RemoteAddr().Network())
+		}
+		m := new(dns.Msg)
+		m.SetReply(q)
+		a, _ := dns.NewRR(q.Question[0].Name + " IN A 127.0.0.1")
+		m.Answer = append(m.Answer, a)
+		w.WriteMsg(m)
+	}), wg)
+	defer func() {
+		s.Stop()
+		wg.Wait()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"doq"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(doqNoError, "")
+
+	// Several queries on the same connection, each one on its own stream.
+	for i := 0; i < 3; i++ {
+		stream, err := conn.OpenStreamSync(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		q.Id = 0
+		buf, _ := q.Pack()
+		b := make([]byte, 2+len(buf))
+		binary.BigEndian.PutUint16(b, uint16(len(buf)))
+		copy(b[2:], buf)
+		stream.Write(b)
+		stream.Close()
+
+		resp, err := io.ReadAll(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := new(dns.Msg)
+		if len(resp) < 2 || int(binary.BigEndian.Uint16(resp)) != len(resp)-2 {
+			t.Fatalf("invalid response length: %d", len(resp))
+		}
+		if err := m.Unpack(resp[2:]); err != nil {
+			t.Fatal(err)
+		}
+		if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "127.0.0.1" {
+			t.Errorf("unexpected answer: %v", m.Answer)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package inbound
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"io"
 	"net"
@@ -12,50 +13,107 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/shawn1m/overture/core/common"
+	"github.com/shawn1m/overture/core/dnstap"
+	"github.com/shawn1m/overture/core/hosts"
 	"github.com/shawn1m/overture/core/matcher"
+	"github.com/shawn1m/overture/core/metrics"
 	"github.com/shawn1m/overture/core/outbound"
 	"github.com/shawn1m/overture/core/querylog"
 	"github.com/shawn1m/overture/core/replace"
+	"github.com/shawn1m/overture/core/stats"
 )
 
 type Server struct {
-	bindAddress      []string
-	debugHttpAddress string
-	dispatcher       outbound.Dispatcher
-	rejectQType      []uint16
-	HTTPMux          *http.ServeMux
-	ctx              context.Context
-	cancel           context.CancelFunc
-
-	blockDomainList   matcher.Matcher
-	blockIPList       *common.IPSet
-	replaceDomainList *replace.DomainReplace
-	replaceIPList     *replace.IPReplace
+	bindAddress     []string
+	tlsBindAddress  []string
+	quicBindAddress []string
+	tlsConfig       *tls.Config
+	doh             *DoHConfig
+	debugHTTP       *DebugHTTPConfig
+	dispatcher      atomic.Pointer[outbound.Dispatcher]
+	HTTPMux         *http.ServeMux
+	ctx             context.Context
+	cancel          context.CancelFunc
+
+	lists atomic.Pointer[Lists]
 }
 
-func NewServer(bindAddress []string, debugHTTPAddress string, dispatcher outbound.Dispatcher, rejectQType []uint16, blockDomainList matcher.Matcher, blockIPList *common.IPSet, replaceDomainList *replace.DomainReplace, replaceIPList *replace.IPReplace) *Server {
+// Lists are the reject, block and replace lists of the server, they are replaced as a whole when
+// edited or reloaded at runtime.
+type Lists struct {
+	RejectQType       []uint16
+	BlockDomainList   matcher.Matcher
+	BlockIPList       *common.IPSet
+	ReplaceDomainList *replace.DomainReplace
+	ReplaceIPList     *replace.IPReplace
+}
+
+// DoHConfig holds the settings of DNS-over-HTTPS listeners.
+type DoHConfig struct {
+	HTTPSBindAddress []string
+	HTTPBindAddress  []string
+	Path             string
+	TrustedProxySet  *common.IPSet
+}
+
+func NewServer(bindAddress []string, tlsBindAddress []string, quicBindAddress []string, tlsConfig *tls.Config, doh *DoHConfig, debugHTTP *DebugHTTPConfig, dispatcher outbound.Dispatcher, rejectQType []uint16, blockDomainList matcher.Matcher, blockIPList *common.IPSet, replaceDomainList *replace.DomainReplace, replaceIPList *replace.IPReplace) *Server {
 	s := &Server{
-		bindAddress:       bindAddress,
-		debugHttpAddress:  debugHTTPAddress,
-		dispatcher:        dispatcher,
-		rejectQType:       rejectQType,
-		blockDomainList:   blockDomainList,
-		blockIPList:       blockIPList,
-		replaceDomainList: replaceDomainList,
-		replaceIPList:     replaceIPList,
+		bindAddress:     bindAddress,
+		tlsBindAddress:  tlsBindAddress,
+		quicBindAddress: quicBindAddress,
+		tlsConfig:       tlsConfig,
+		doh:             doh,
+		debugHTTP:       debugHTTP,
 	}
+	s.dispatcher.Store(&dispatcher)
+	s.lists.Store(&Lists{
+		RejectQType:       rejectQType,
+		BlockDomainList:   blockDomainList,
+		BlockIPList:       blockIPList,
+		ReplaceDomainList: replaceDomainList,
+		ReplaceIPList:     replaceIPList,
+	})
 	s.ctx, s.cancel = context.WithCancel(context.Background())
 	s.HTTPMux = http.NewServeMux()
 	return s
 }
 
+// Dispatcher returns the dispatcher in use
+func (s *Server) Dispatcher() *outbound.Dispatcher {
+	return s.dispatcher.Load()
+}
+
+// SetDispatcher replaces the dispatcher and returns the old one, queries being served keep the old one
+func (s *Server) SetDispatcher(d outbound.Dispatcher) *outbound.Dispatcher {
+	return s.dispatcher.Swap(&d)
+}
+
+// SetHosts replaces hosts of the dispatcher, queries being served keep the old ones
+func (s *Server) SetHosts(h *hosts.Hosts) {
+	d := *s.dispatcher.Load()
+	d.Hosts = h
+	s.dispatcher.Store(&d)
+}
+
+// Lists returns the block and replace lists in use
+func (s *Server) Lists() *Lists {
+	return s.lists.Load()
+}
+
+// SetLists replaces the block and replace lists, queries being served keep the old ones
+func (s *Server) SetLists(l *Lists) {
+	s.lists.Store(l)
+}
+
 func (s *Server) DumpCache(w http.ResponseWriter, req *http.Request) {
-	if s.dispatcher.Cache == nil {
+	dispatcher := s.Dispatcher()
+	if dispatcher.Cache == nil {
 		io.WriteString(w, "error: cache not enabled")
 		return
 	}
@@ -79,7 +137,7 @@ func (s *Server) DumpCache(w http.ResponseWriter, req *http.Request) {
 		nobody = false
 	}
 
-	rs, l := s.dispatcher.Cache.Dump(nobody)
+	rs, l := dispatcher.Cache.Dump(nobody)
 	body := make(map[string][]*answer)
 
 	for k, es := range rs {
@@ -101,7 +159,7 @@ func (s *Server) DumpCache(w http.ResponseWriter, req *http.Request) {
 	res := response{
 		Body:     body,
 		Length:   l,
-		Capacity: s.dispatcher.Cache.Capacity(),
+		Capacity: dispatcher.Cache.Capacity(),
 	}
 
 	responseBytes, err := json.Marshal(&res)
@@ -113,72 +171,156 @@ func (s *Server) DumpCache(w http.ResponseWriter, req *http.Request) {
 	io.WriteString(w, string(responseBytes))
 }
 
+func (s *Server) DumpUpstream(w http.ResponseWriter, req *http.Request) {
+	responseBytes, err := json.Marshal(s.Dispatcher().HealthStatus())
+	if err != nil {
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	io.WriteString(w, string(responseBytes))
+}
+
+func (s *Server) DumpStats(w http.ResponseWriter, req *http.Request) {
+	n, _ := strconv.Atoi(req.URL.Query().Get("top"))
+	responseBytes, err := json.Marshal(stats.Default().Report(n))
+	if err != nil {
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	io.WriteString(w, string(responseBytes))
+}
+
 func (s *Server) Run() {
 
 	mux := dns.NewServeMux()
 	mux.Handle(".", s)
 
 	wg := new(sync.WaitGroup)
-	wg.Add(2 * len(s.bindAddress))
 
 	log.Infof("Overture is listening on %s", s.bindAddress)
 
 	for _, a := range s.bindAddress {
 		for _, p := range [2]string{"tcp", "udp"} {
-			go func(p string, a string) {
-
-				// Manual create server inorder to have a way to close it.
-				srv := &dns.Server{Addr: a, Net: p, Handler: mux}
-				go func() {
-					<-s.ctx.Done()
-					log.Warnf("Shutting down the server on protocol %s", p)
-					srv.ShutdownContext(s.ctx)
-				}()
-				err := srv.ListenAndServe()
-				if err != nil {
-					log.Fatalf("Listening on port %s failed: %s", p, err)
-					os.Exit(1)
-				}
-				wg.Done()
-			}(p, a)
+			s.listenDNS(&dns.Server{Addr: a, Net: p, Handler: mux}, wg)
 		}
 	}
 
-	if s.debugHttpAddress != "" {
+	if len(s.tlsBindAddress) > 0 {
+		if s.tlsConfig == nil {
+			log.Fatalf("TLS certificate is required for listening on %s", s.tlsBindAddress)
+			os.Exit(1)
+		}
+		log.Infof("Overture is listening on %s (tcp-tls)", s.tlsBindAddress)
+		for _, a := range s.tlsBindAddress {
+			s.listenDNS(&dns.Server{Addr: a, Net: "tcp-tls", TLSConfig: s.tlsConfig, Handler: mux}, wg)
+		}
+	}
+
+	if len(s.quicBindAddress) > 0 {
+		if s.tlsConfig == nil {
+			log.Fatalf("TLS certificate is required for listening on %s", s.quicBindAddress)
+			os.Exit(1)
+		}
+		log.Infof("Overture is listening on %s (quic)", s.quicBindAddress)
+		for _, a := range s.quicBindAddress {
+			s.listenQUIC(a, mux, wg)
+		}
+	}
+
+	if s.doh != nil && len(s.doh.HTTPSBindAddress)+len(s.doh.HTTPBindAddress) > 0 {
+		handler := &dohHandler{server: s, path: s.doh.Path, trustedProxies: s.doh.TrustedProxySet}
+		if handler.path == "" {
+			handler.path = "/dns-query"
+		}
+		if len(s.doh.HTTPSBindAddress) > 0 && s.tlsConfig == nil {
+			log.Fatalf("TLS certificate is required for listening on %s", s.doh.HTTPSBindAddress)
+			os.Exit(1)
+		}
+		for _, a := range s.doh.HTTPSBindAddress {
+			log.Infof("Overture is listening on https://%s%s", a, handler.path)
+			s.listenHTTP(&http.Server{Addr: a, Handler: handler, TLSConfig: s.tlsConfig}, wg)
+		}
+		for _, a := range s.doh.HTTPBindAddress {
+			log.Infof("Overture is listening on http://%s%s", a, handler.path)
+			s.listenHTTP(&http.Server{Addr: a, Handler: handler}, wg)
+		}
+	}
+
+	if s.debugHTTP != nil && s.debugHTTP.Address != "" {
 		s.HTTPMux.HandleFunc("/cache", s.DumpCache)
-		s.HTTPMux.HandleFunc("/debug/pprof/", pprof.Index)
-		s.HTTPMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-		s.HTTPMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
-		s.HTTPMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-		s.HTTPMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		s.HTTPMux.HandleFunc("/upstream", s.DumpUpstream)
+		s.HTTPMux.HandleFunc("/stats", s.DumpStats)
+		s.HTTPMux.HandleFunc("/querylog", s.DumpQueryLog)
+		s.HTTPMux.Handle("/dashboard/", dashboardHandler())
+		s.HTTPMux.Handle("/metrics", metrics.Handler())
+		if !s.debugHTTP.DisablePprof {
+			s.HTTPMux.HandleFunc("/debug/pprof/", pprof.Index)
+			s.HTTPMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+			s.HTTPMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+			s.HTTPMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+			s.HTTPMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		}
 
-		wg.Add(1)
-		go func() {
-			// Manual create server inorder to have a way to close it.
-			srv := &http.Server{
-				Addr:    s.debugHttpAddress,
-				Handler: s.HTTPMux,
-			}
-			go func() {
-				<-s.ctx.Done()
-				log.Warnf("Shutting down debug HTTP server")
-				srv.Shutdown(s.ctx)
-			}()
-
-			err := srv.ListenAndServe()
-			if err != http.ErrServerClosed {
-				log.Fatalf("Debug HTTP Server Listen on port %s  faild: %s", s.debugHttpAddress, err)
-				os.Exit(1)
-			}
-			wg.Done()
-		}()
+		scheme := "http"
+		if s.debugHTTP.TLSConfig != nil {
+			scheme = "https"
+		}
+		log.Infof("Debug HTTP server is listening on %s://%s", scheme, s.debugHTTP.Address)
+		s.listenHTTP(&http.Server{Addr: s.debugHTTP.Address, Handler: s.debugHTTP.handler(s.HTTPMux), TLSConfig: s.debugHTTP.TLSConfig}, wg)
 	}
 
 	wg.Wait()
 }
 
+// Manual create server inorder to have a way to close it.
+func (s *Server) listenDNS(srv *dns.Server, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		go func() {
+			<-s.ctx.Done()
+			log.Warnf("Shutting down the server on protocol %s", srv.Net)
+			srv.ShutdownContext(s.ctx)
+		}()
+		err := srv.ListenAndServe()
+		if err != nil {
+			log.Fatalf("Listening on port %s failed: %s", srv.Net, err)
+			os.Exit(1)
+		}
+		wg.Done()
+	}()
+}
+
+// Manual create server inorder to have a way to close it, TLS is enabled if srv.TLSConfig is set.
+func (s *Server) listenHTTP(srv *http.Server, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		go func() {
+			<-s.ctx.Done()
+			log.Warnf("Shutting down HTTP server on %s", srv.Addr)
+			srv.Shutdown(s.ctx)
+		}()
+
+		var err error
+		if srv.TLSConfig != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatalf("HTTP Server Listen on %s failed: %s", srv.Addr, err)
+			os.Exit(1)
+		}
+		wg.Done()
+	}()
+}
+
 func (s *Server) Stop() {
 	s.cancel()
+	if d := s.Dispatcher(); d != nil {
+		d.Stop()
+	}
 }
 
 func (s *Server) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
@@ -186,32 +328,65 @@ func (s *Server) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
 
 	log.Debugf("Question from %s: %s", inboundIP, q.Question[0].String())
 
-	for _, qt := range s.rejectQType {
+	var responseMessage *dns.Msg
+	lists := s.Lists()
+	blockReason := ""
+	entry := querylog.NewEntry(inboundIP, q)
+	isTap := dnstap.Enabled()
+	if isTap {
+		dnstap.ClientQuery(w.RemoteAddr(), socketProtocol(w), q, entry.Time)
+	}
+	defer func() {
+		entry.SetResponse(responseMessage)
+		querylog.Write(entry)
+		stats.Default().Record(entry.Time, entry.ClientIP, entry.Name, blockReason)
+		if isTap {
+			resp := responseMessage
+			if resp == nil {
+				resp = new(dns.Msg)
+				resp.SetRcode(q, dns.RcodeServerFailure)
+			}
+			dnstap.ClientResponse(w.RemoteAddr(), socketProtocol(w), q, resp, entry.Time)
+		}
+	}()
+
+	for _, qt := range lists.RejectQType {
 		if isQuestionType(q, qt) {
 			log.Debugf("Reject %s: %s", inboundIP, q.Question[0].String())
-			querylog.Log(inboundIP, q, "Block")
+			entry.Tag = "Block"
+			blockReason = "qtype"
+			entry.AddRule("reject qtype " + dns.Type(qt).String())
+			metrics.Query(q, "Block")
+			metrics.Block("qtype")
+			metrics.Response(dns.RcodeServerFailure)
 			dns.HandleFailed(w, q)
 			return
 		}
 	}
 
 	qCopy := q
-	replaceDomain := s.replaceDomainList.Find(q.Question[0].Name)
+	replaceDomain := lists.ReplaceDomainList.Find(q.Question[0].Name)
 	if replaceDomain != "" {
 		log.Debugf("replace domain: %s -> %s", q.Question[0].Name, replaceDomain)
+		entry.AddRule("replace domain " + replaceDomain)
 		qCopy = q.Copy()
 		qCopy.Question[0].Name = replaceDomain + "."
 	}
 
-	var responseMessage *dns.Msg
-	if s.isBlockDomain(q) {
+	if isBlockDomain(lists.BlockDomainList, q) {
 		responseMessage = common.EmptyDNSMsg(q)
 		log.Debugf("Block %s: %s", inboundIP, q.Question[0].String())
+		entry.Tag = "Block"
+		blockReason = "domain"
+		entry.AddRule("block domain")
+		metrics.Query(q, "Block")
+		metrics.Block("domain")
 	} else {
-		responseMessage = s.dispatcher.Exchange(qCopy, inboundIP)
+		responseMessage = s.Dispatcher().ExchangeWithEntry(qCopy, inboundIP, entry)
 	}
 
 	if responseMessage == nil {
+		metrics.Response(dns.RcodeServerFailure)
 		dns.HandleFailed(w, q)
 		return
 	}
@@ -227,8 +402,11 @@ func (s *Server) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
 		} else if i.Header().Rrtype == dns.TypeAAAA {
 			ip = net.ParseIP(i.(*dns.AAAA).AAAA.String())
 		}
-		if s.blockIPList.Contains(ip, false, "block") {
+		if lists.BlockIPList.Contains(ip, false, "block") {
 			log.Debugf("block IP: %s - %s - %s", inboundIP, q.Question[0].Name, ip)
+			entry.AddRule("block ip " + ip.String())
+			metrics.Block("ip")
+			blockReason = "ip"
 			continue
 		}
 		answer = append(answer, i)
@@ -260,13 +438,14 @@ func (s *Server) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
 		} else {
 			continue
 		}
-		replaceIP = s.replaceIPList.Find(ip)
+		replaceIP = lists.ReplaceIPList.Find(ip)
 		if replaceIP != nil {
 			break
 		}
 	}
 	if replaceIP != nil {
 		log.Debugf("replace IP: %s -> %s", q.Question[0].Name, replaceIP)
+		entry.AddRule("replace ip " + replaceIP.String())
 		var rr dns.RR
 		if replaceIP.To4() != nil {
 			rr, _ = dns.NewRR(responseMessage.Question[0].Name + " IN A " + replaceIP.String())
@@ -292,6 +471,7 @@ func (s *Server) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
 		responseMessage.Truncate(udpsize)
 	}
 
+	metrics.Response(responseMessage.Rcode)
 	err := w.WriteMsg(responseMessage)
 	if err != nil {
 		log.Warnf("Write message failed, message: %s, error: %s", responseMessage, err)
@@ -299,10 +479,21 @@ func (s *Server) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
 	}
 }
 
+// socketProtocol returns the protocol of inbound server: "udp", "tcp", "tcp-tls", "https" or "quic"
+func socketProtocol(w dns.ResponseWriter) string {
+	if _, ok := w.(*dohResponseWriter); ok {
+		return "https"
+	}
+	if cs, ok := w.(dns.ConnectionStater); ok && cs.ConnectionState() != nil {
+		return "tcp-tls"
+	}
+	return w.RemoteAddr().Network()
+}
+
 func isQuestionType(q *dns.Msg, qt uint16) bool { return q.Question[0].Qtype == qt }
 
-func (s *Server) isBlockDomain(query *dns.Msg) bool {
+func isBlockDomain(blockDomainList matcher.Matcher, query *dns.Msg) bool {
 	name := query.Question[0].Name
 	name = name[:len(name)-1]
-	return s.blockDomainList.Has(name)
+	return blockDomainList.Has(name)
 }
@@ -0,0 +1,152 @@
+// Copyright (c) 2016 shawn1m. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Package metrics exports prometheus metrics of overture.
+package metrics
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/shawn1m/overture/core/cache"
+	"github.com/shawn1m/overture/core/dnstap"
+)
+
+const namespace = "overture"
+
+var (
+	queries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queries_total",
+		Help:      "Number of queries by question type and the tag used in query log.",
+	}, []string{"qtype", "tag"})
+
+	responses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "responses_total",
+		Help:      "Number of responses by rcode.",
+	}, []string{"rcode"})
+
+	blocked = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "blocked_total",
+		Help:      "Number of blocked queries and answers by reason.",
+	}, []string{"reason"})
+
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Latency of requests to upstreams.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"upstream"})
+
+	upstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_errors_total",
+		Help:      "Number of failed requests to upstreams.",
+	}, []string{"upstream"})
+
+	cacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_hits_total",
+		Help:      "Number of queries answered from cache.",
+	})
+
+	cacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_misses_total",
+		Help:      "Number of queries not found in cache.",
+	})
+
+	registry = prometheus.NewRegistry()
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		queries, responses, blocked, upstreamDuration, upstreamErrors, cacheHits, cacheMisses,
+		&cacheCollector{},
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "dnstap_dropped_total",
+			Help:      "Number of dnstap frames dropped because the buffer was full.",
+		}, func() float64 { return float64(dnstap.Dropped()) }),
+	)
+}
+
+// Handler returns the http handler for "/metrics"
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// Query records a query with the tag used in query log
+func Query(query *dns.Msg, tag string) {
+	queries.WithLabelValues(dns.Type(query.Question[0].Qtype).String(), tag).Inc()
+}
+
+// Response records the rcode of a response
+func Response(rcode int) {
+	responses.WithLabelValues(dns.RcodeToString[rcode]).Inc()
+}
+
+// Block records a blocked query or answer, reason is one of "qtype", "domain" and "ip"
+func Block(reason string) {
+	blocked.WithLabelValues(reason).Inc()
+}
+
+// Upstream records a request to upstream
+func Upstream(name string, rtt time.Duration, err error) {
+	if err != nil {
+		upstreamErrors.WithLabelValues(name).Inc()
+		return
+	}
+	upstreamDuration.WithLabelValues(name).Observe(rtt.Seconds())
+}
+
+// CacheHit records whether a query is answered from cache
+func CacheHit(hit bool) {
+	if hit {
+		cacheHits.Inc()
+	} else {
+		cacheMisses.Inc()
+	}
+}
+
+var currentCache atomic.Pointer[cache.Cache]
+
+// SetCache sets the cache whose size and evictions are exported, it is changed on reload
+func SetCache(c *cache.Cache) {
+	currentCache.Store(c)
+}
+
+var (
+	cacheEntriesDesc   = prometheus.NewDesc(namespace+"_cache_entries", "Number of elements in cache.", nil, nil)
+	cacheBytesDesc     = prometheus.NewDesc(namespace+"_cache_bytes", "Estimated memory used by cached messages.", nil, nil)
+	cacheEvictionsDesc = prometheus.NewDesc(namespace+"_cache_evictions_total", "Number of elements evicted because cache was full.", nil, nil)
+)
+
+type cacheCollector struct{}
+
+func (cc *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheEntriesDesc
+	ch <- cacheBytesDesc
+	ch <- cacheEvictionsDesc
+}
+
+func (cc *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	c := currentCache.Load()
+	if c == nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(cacheEntriesDesc, prometheus.GaugeValue, float64(c.Len()))
+	ch <- prometheus.MustNewConstMetric(cacheBytesDesc, prometheus.GaugeValue, float64(c.Bytes()))
+	ch <- prometheus.MustNewConstMetric(cacheEvictionsDesc, prometheus.CounterValue, float64(c.Evictions()))
+}
@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/shawn1m/overture/core/cache"
+)
+
+func TestHandler(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeAAAA)
+	Query(q, "Primary")
+	Response(dns.RcodeNameError)
+	Block("domain")
+	Upstream("Test", 10*time.Millisecond, nil)
+	Upstream("Test", 0, errors.New("timeout"))
+	CacheHit(false)
+
+	c := cache.New(10, 0, 0)
+	defer c.Close()
+	c.InsertMessage("example.com. 1 ", q, 60)
+	SetCache(c)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(rec.Body)
+
+	for _, want := range []string{
+		`overture_queries_total{qtype="AAAA",tag="Primary"} 1`,
+		`overture_responses_total{rcode="NXDOMAIN"} 1`,
+		`overture_blocked_total{reason="domain"} 1`,
+		`overture_upstream_request_duration_seconds_count{upstream="Test"} 1`,
+		`overture_upstream_errors_total{upstream="Test"} 1`,
+		`overture_cache_misses_total 1`,
+		`overture_cache_entries 1`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics should contain %s", want)
+		}
+	}
+}
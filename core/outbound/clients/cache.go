@@ -35,6 +35,19 @@ func (c *CacheClient) Exchange() *dns.Msg {
 	return nil
 }
 
+// ExchangeStale returns the cached response even if it is expired but still in the stale window
+func (c *CacheClient) ExchangeStale() *dns.Msg {
+	if c.cache == nil {
+		return nil
+	}
+
+	m := c.cache.HitStale(cache.Key(c.questionMessage.Question[0], c.ednsClientSubnetIP), c.questionMessage.Id)
+	if m != nil {
+		log.Debugf("Stale cache hit: %s", cache.Key(c.questionMessage.Question[0], c.ednsClientSubnetIP))
+	}
+	return m
+}
+
 func (c *CacheClient) exchangeFromCache() bool {
 	if c.cache == nil {
 		return false
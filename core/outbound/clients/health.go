@@ -0,0 +1,197 @@
+/*
+ * Copyright (c) 2019 shawn1m. All rights reserved.
+ * Use of this source code is governed by The MIT License (MIT) that can be
+ * found in the LICENSE file..
+ */
+
+package clients
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/shawn1m/overture/core/common"
+	"github.com/shawn1m/overture/core/errors"
+	"github.com/shawn1m/overture/core/outbound/clients/resolver"
+)
+
+// Weight of the newest sample in latency EWMA
+const latencyEWMAWeight = 0.3
+
+const defaultEjectTime = 30 * time.Second
+
+// UpstreamHealth tracks the health of a single DNS upstream. An upstream is ejected after
+// HealthCheck.MaxFails consecutive failures, and re-admitted when an active probe succeeds, or
+// after HealthCheck.EjectTime if active probing is disabled.
+type UpstreamHealth struct {
+	upstream *common.DNSUpstream
+	resolver resolver.Resolver
+
+	lock                sync.RWMutex
+	consecutiveFailures int
+	latency             time.Duration
+	ejected             bool
+	ejectedAt           time.Time
+	lastError           string
+	queries             uint64
+	failures            uint64
+}
+
+// HealthStatus is a snapshot of UpstreamHealth, for debugging
+type HealthStatus struct {
+	Name                string     `json:"name"`
+	Address             string     `json:"address"`
+	Available           bool       `json:"available"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	Latency             float64    `json:"latency_ms"`
+	Queries             uint64     `json:"queries"`
+	Failures            uint64     `json:"failures"`
+	LastError           string     `json:"last_error,omitempty"`
+	EjectedAt           *time.Time `json:"ejected_at,omitempty"`
+}
+
+func NewUpstreamHealth(u *common.DNSUpstream, r resolver.Resolver) *UpstreamHealth {
+	return &UpstreamHealth{upstream: u, resolver: r}
+}
+
+// Report records the result of an exchange with the upstream.
+func (h *UpstreamHealth) Report(rtt time.Duration, err error) {
+	if h == nil {
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.queries++
+	if err != nil {
+		h.failures++
+		h.consecutiveFailures++
+		h.lastError = err.Error()
+		if h.ejected {
+			// Still failing, restart the eject time.
+			h.ejectedAt = time.Now()
+		} else if h.upstream.HealthCheck.MaxFails > 0 && h.consecutiveFailures >= h.upstream.HealthCheck.MaxFails {
+			h.ejected = true
+			h.ejectedAt = time.Now()
+			log.Warnf("DNSUpstream %s has failed %d times in a row, ejected: %s", h.upstream.Name, h.consecutiveFailures, err)
+		}
+		return
+	}
+
+	if h.latency == 0 {
+		h.latency = rtt
+	} else {
+		h.latency = time.Duration(latencyEWMAWeight*float64(rtt) + (1-latencyEWMAWeight)*float64(h.latency))
+	}
+	h.consecutiveFailures = 0
+	if h.ejected {
+		h.ejected = false
+		log.Infof("DNSUpstream %s has recovered, re-admitted", h.upstream.Name)
+	}
+}
+
+// IsAvailable returns false if the upstream is ejected.
+func (h *UpstreamHealth) IsAvailable() bool {
+	if h == nil {
+		return true
+	}
+
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	if !h.ejected {
+		return true
+	}
+	// Without active probing, let queries go through after eject time to find out whether it has recovered.
+	if h.upstream.HealthCheck.ProbeInterval <= 0 {
+		return time.Since(h.ejectedAt) > h.ejectTime()
+	}
+	return false
+}
+
+// Latency returns the EWMA of exchange latency, 0 if no exchange succeeded yet.
+func (h *UpstreamHealth) Latency() time.Duration {
+	if h == nil {
+		return 0
+	}
+
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.latency
+}
+
+func (h *UpstreamHealth) Status() HealthStatus {
+	available := h.IsAvailable()
+
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	s := HealthStatus{
+		Name:                h.upstream.Name,
+		Address:             h.upstream.Address,
+		Available:           available,
+		ConsecutiveFailures: h.consecutiveFailures,
+		Latency:             float64(h.latency) / float64(time.Millisecond),
+		Queries:             h.queries,
+		Failures:            h.failures,
+		LastError:           h.lastError,
+	}
+	if h.ejected {
+		t := h.ejectedAt
+		s.EjectedAt = &t
+	}
+	return s
+}
+
+func (h *UpstreamHealth) ejectTime() time.Duration {
+	if h.upstream.HealthCheck.EjectTime > 0 {
+		return time.Duration(h.upstream.HealthCheck.EjectTime) * time.Second
+	}
+	return defaultEjectTime
+}
+
+// Probe sends HealthCheck.ProbeName to the upstream and reports the result.
+func (h *UpstreamHealth) Probe() {
+	name := h.upstream.HealthCheck.ProbeName
+	qtype := dns.TypeA
+	if name == "" || name == "." {
+		name = "."
+		qtype = dns.TypeNS
+	}
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(name), qtype)
+
+	start := time.Now()
+	resp, err := h.resolver.Exchange(q)
+	if err == nil && resp == nil {
+		err = &errors.NormalError{Message: "response message returned nil"}
+	}
+	if err == nil && (resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused) {
+		err = &errors.NormalError{Message: "probe returned " + dns.RcodeToString[resp.Rcode]}
+	}
+	log.Debugf("Probe %s: %s %v", h.upstream.Name, time.Since(start), err)
+	h.Report(time.Since(start), err)
+}
+
+// RunProbe probes the upstream every HealthCheck.ProbeInterval seconds until ctx is done.
+func (h *UpstreamHealth) RunProbe(ctx context.Context) {
+	if h.upstream.HealthCheck.ProbeInterval <= 0 || h.resolver == nil {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(h.upstream.HealthCheck.ProbeInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.Probe()
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package clients
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/shawn1m/overture/core/common"
+	"github.com/shawn1m/overture/core/outbound/clients/resolver"
+)
+
+type fakeResolver struct {
+	fail    atomic.Bool
+	queries atomic.Int32
+	delay   time.Duration
+}
+
+func (r *fakeResolver) Init() error { return nil }
+
+func (r *fakeResolver) Exchange(q *dns.Msg) (*dns.Msg, error) {
+	r.queries.Add(1)
+	time.Sleep(r.delay)
+	if r.fail.Load() {
+		return nil, errors.New("fake failure")
+	}
+	m := new(dns.Msg)
+	m.SetReply(q)
+	a, _ := dns.NewRR(q.Question[0].Name + " IN A 127.0.0.1")
+	m.Answer = append(m.Answer, a)
+	return m, nil
+}
+
+func newTestUpstream(name string) *common.DNSUpstream {
+	u := &common.DNSUpstream{Name: name, EDNSClientSubnet: &common.EDNSClientSubnetType{Policy: "disable"}}
+	u.HealthCheck.MaxFails = 2
+	return u
+}
+
+func TestUpstreamHealth(t *testing.T) {
+	u := newTestUpstream("test")
+	r := &fakeResolver{}
+	h := NewUpstreamHealth(u, r)
+
+	h.Report(10*time.Millisecond, nil)
+	h.Report(20*time.Millisecond, nil)
+	if l := h.Latency(); l <= 10*time.Millisecond || l >= 20*time.Millisecond {
+		t.Errorf("unexpected latency %s", l)
+	}
+
+	h.Report(0, errors.New("timeout"))
+	if !h.IsAvailable() {
+		t.Error("upstream should not be ejected after 1 failure")
+	}
+	h.Report(0, errors.New("timeout"))
+	if h.IsAvailable() {
+		t.Error("upstream should be ejected after 2 failures")
+	}
+
+	// Without active probing, the upstream is given a chance after eject time.
+	h.ejectedAt = time.Now().Add(-time.Hour)
+	if !h.IsAvailable() {
+		t.Error("upstream should be available after eject time")
+	}
+	h.Report(0, errors.New("timeout"))
+	if h.IsAvailable() {
+		t.Error("upstream should be ejected again after another failure")
+	}
+
+	// A successful probe re-admits the upstream.
+	u.HealthCheck.ProbeInterval = 1
+	h.Probe()
+	if !h.IsAvailable() || h.Status().ConsecutiveFailures != 0 {
+		t.Error("upstream should be re-admitted after a successful probe")
+	}
+}
+
+func TestRemoteClientBundleSkipEjected(t *testing.T) {
+	ul := []*common.DNSUpstream{newTestUpstream("bad"), newTestUpstream("good")}
+	// The good one is slower, so the failure is always reported before the bundle returns.
+	bad, good := &fakeResolver{}, &fakeResolver{delay: 10 * time.Millisecond}
+	bad.fail.Store(true)
+	healths := []*UpstreamHealth{NewUpstreamHealth(ul[0], bad), NewUpstreamHealth(ul[1], good)}
+
+	exchange := func(name string) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		cb := NewClientBundle(q, ul, []resolver.Resolver{bad, good}, healths, &ParallelStrategy{}, "", 0, 0, nil, "Test", nil)
+		return cb.Exchange(false, false)
+	}
+
+	for i, name := range []string{"a.example.", "b.example.", "c.example."} {
+		if resp := exchange(name); common.FindRecordByType(resp, dns.TypeA) != "127.0.0.1" {
+			t.Errorf("query %d should succeed", i)
+		}
+	}
+	if n := bad.queries.Load(); n != 2 {
+		t.Errorf("ejected upstream got %d queries, want 2", n)
+	}
+	if healths[0].IsAvailable() || !healths[1].IsAvailable() {
+		t.Error("only the failing upstream should be ejected")
+	}
+}
@@ -23,14 +23,15 @@ type LocalClient struct {
 	questionMessage *dns.Msg
 
 	minimumTTL   int
+	maximumTTL   int
 	domainTTLMap map[string]uint32
 
 	hosts   *hosts.Hosts
 	rawName string
 }
 
-func NewLocalClient(q *dns.Msg, h *hosts.Hosts, minimumTTL int, domainTTLMap map[string]uint32) *LocalClient {
-	c := &LocalClient{questionMessage: q.Copy(), hosts: h, minimumTTL: minimumTTL, domainTTLMap: domainTTLMap}
+func NewLocalClient(q *dns.Msg, h *hosts.Hosts, minimumTTL int, maximumTTL int, domainTTLMap map[string]uint32) *LocalClient {
+	c := &LocalClient{questionMessage: q.Copy(), hosts: h, minimumTTL: minimumTTL, maximumTTL: maximumTTL, domainTTLMap: domainTTLMap}
 	c.rawName = c.questionMessage.Question[0].Name
 	return c
 }
@@ -39,6 +40,7 @@ func (c *LocalClient) Exchange() *dns.Msg {
 	if c.exchangeFromHosts() || c.exchangeFromIP() {
 		if c.responseMessage != nil {
 			common.SetMinimumTTL(c.responseMessage, uint32(c.minimumTTL))
+			common.SetMaximumTTL(c.responseMessage, uint32(c.maximumTTL))
 			common.SetTTLByMap(c.responseMessage, c.domainTTLMap)
 		}
 		return c.responseMessage
@@ -11,12 +11,16 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/shawn1m/overture/core/cache"
 	"github.com/shawn1m/overture/core/common"
+	"github.com/shawn1m/overture/core/dnstap"
+	"github.com/shawn1m/overture/core/errors"
+	"github.com/shawn1m/overture/core/metrics"
 	"github.com/shawn1m/overture/core/outbound/clients/resolver"
 )
 
@@ -28,6 +32,7 @@ type RemoteClient struct {
 	ednsClientSubnetIP string
 	inboundIP          string
 	dnsResolver        resolver.Resolver
+	health             *UpstreamHealth
 
 	cache *cache.Cache
 
@@ -37,8 +42,8 @@ type RemoteClient struct {
 
 var pendingRequest sync.Map
 
-func NewClient(q *dns.Msg, u *common.DNSUpstream, resolver resolver.Resolver, ip string, cache *cache.Cache) *RemoteClient {
-	c := &RemoteClient{questionMessage: q.Copy(), dnsUpstream: u, dnsResolver: resolver, inboundIP: ip, cache: cache}
+func NewClient(q *dns.Msg, u *common.DNSUpstream, resolver resolver.Resolver, health *UpstreamHealth, ip string, cache *cache.Cache) *RemoteClient {
+	c := &RemoteClient{questionMessage: q.Copy(), dnsUpstream: u, dnsResolver: resolver, health: health, inboundIP: ip, cache: cache}
 	c.getEDNSClientSubnetIP()
 	c.reqKey = fmt.Sprintf("%s %d %s %s", q.Question[0].Name, q.Question[0].Qtype, c.ednsClientSubnetIP, u.Name)
 
@@ -63,6 +68,11 @@ func (c *RemoteClient) getEDNSClientSubnetIP() {
 	}
 }
 
+// CacheKey returns the key of the query in cache
+func (c *RemoteClient) CacheKey() string {
+	return cache.Key(c.questionMessage.Question[0], c.ednsClientSubnetIP)
+}
+
 func (c *RemoteClient) ExchangeFromCache() *dns.Msg {
 	cacheClient := NewCacheClient(c.questionMessage, c.ednsClientSubnetIP, c.cache)
 	c.responseMessage = cacheClient.Exchange()
@@ -72,6 +82,11 @@ func (c *RemoteClient) ExchangeFromCache() *dns.Msg {
 	return nil
 }
 
+// ExchangeFromStaleCache returns the stale cached response, it does not change the state of the client
+func (c *RemoteClient) ExchangeFromStaleCache() *dns.Msg {
+	return NewCacheClient(c.questionMessage, c.ednsClientSubnetIP, c.cache).ExchangeStale()
+}
+
 func (c *RemoteClient) Exchange(isLog bool) *dns.Msg {
 	if c1, ok := pendingRequest.LoadOrStore(c.reqKey, c); ok {
 		log.Debugf("found pending client %s", c.reqKey)
@@ -106,16 +121,26 @@ func (c *RemoteClient) _exchange(isLog bool) *dns.Msg {
 
 	var temp *dns.Msg
 	var err error
+	start := time.Now()
+	isTap := dnstap.Enabled()
+	if isTap {
+		dnstap.ForwarderQuery(c.dnsUpstream.Protocol, c.dnsUpstream.Address, c.questionMessage, start)
+	}
 	temp, err = c.dnsResolver.Exchange(c.questionMessage)
+	rtt := time.Since(start)
+	if isTap && temp != nil {
+		dnstap.ForwarderResponse(c.dnsUpstream.Protocol, c.dnsUpstream.Address, c.questionMessage, temp, start)
+	}
+	if err == nil && temp == nil {
+		err = &errors.NormalError{Message: "Response message returned nil, maybe timeout? Please check your query or DNS configuration"}
+	}
+	c.health.Report(rtt, err)
+	metrics.Upstream(c.dnsUpstream.Name, rtt, err)
 
 	if err != nil {
 		log.Debugf("%s Fail: %s", c.dnsUpstream.Name, err)
 		return nil
 	}
-	if temp == nil {
-		log.Debugf("%s Fail: Response message returned nil, maybe timeout? Please check your query or DNS configuration", c.dnsUpstream.Name)
-		return nil
-	}
 
 	c.responseMessage = temp
 
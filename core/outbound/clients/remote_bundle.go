@@ -26,43 +26,59 @@ type RemoteClientBundle struct {
 	dnsUpstreams []*common.DNSUpstream
 	inboundIP    string
 	minimumTTL   int
+	maximumTTL   int
 	domainTTLMap map[string]uint32
 
-	cache *cache.Cache
-	Name  string
+	cache       *cache.Cache
+	cacheHitKey string
+	Name        string
+
+	// Upstream and edns client subnet ip of the response
+	answeredUpstream   string
+	ednsClientSubnetIP string
 
 	dnsResolvers []resolver.Resolver
+	healths      []*UpstreamHealth
+	strategy     Strategy
 }
 
-func NewClientBundle(q *dns.Msg, ul []*common.DNSUpstream, resolvers []resolver.Resolver, ip string, minimumTTL int, cache *cache.Cache, name string, domainTTLMap map[string]uint32) *RemoteClientBundle {
-	cb := &RemoteClientBundle{questionMessage: q.Copy(), dnsUpstreams: ul, dnsResolvers: resolvers, inboundIP: ip, minimumTTL: minimumTTL, cache: cache, Name: name, domainTTLMap: domainTTLMap}
+func NewClientBundle(q *dns.Msg, ul []*common.DNSUpstream, resolvers []resolver.Resolver, healths []*UpstreamHealth, strategy Strategy, ip string, minimumTTL int, maximumTTL int, cache *cache.Cache, name string, domainTTLMap map[string]uint32) *RemoteClientBundle {
+	cb := &RemoteClientBundle{questionMessage: q.Copy(), dnsUpstreams: ul, dnsResolvers: resolvers, healths: healths, strategy: strategy, inboundIP: ip, minimumTTL: minimumTTL, maximumTTL: maximumTTL, cache: cache, Name: name, domainTTLMap: domainTTLMap}
 
 	for i, u := range ul {
-		c := NewClient(cb.questionMessage, u, cb.dnsResolvers[i], cb.inboundIP, cb.cache)
+		c := NewClient(cb.questionMessage, u, cb.dnsResolvers[i], cb.healths[i], cb.inboundIP, cb.cache)
 		cb.clients = append(cb.clients, c)
 	}
 
 	return cb
 }
 
-func (cb *RemoteClientBundle) Exchange(isCache bool, isLog bool) *dns.Msg {
-	ch := make(chan *RemoteClient, len(cb.clients))
-
-	for _, o := range cb.clients {
-		go func(c *RemoteClient, ch chan *RemoteClient) {
-			c.Exchange(isLog)
-			ch <- c
-		}(o, ch)
+// availableClients returns clients whose upstream is not ejected, or all clients if every upstream is ejected.
+func (cb *RemoteClientBundle) availableClients() []*RemoteClient {
+	var cl []*RemoteClient
+	for _, c := range cb.clients {
+		if c.health.IsAvailable() {
+			cl = append(cl, c)
+		}
+	}
+	if len(cl) == 0 {
+		log.Debugf("All upstreams in %s are ejected, trying all of them", cb.Name)
+		return cb.clients
 	}
+	return cl
+}
+
+func (cb *RemoteClientBundle) Exchange(isCache bool, isLog bool) *dns.Msg {
+	clients := cb.availableClients()
 
 	var ec, fallbackc1, fallbackc2 *RemoteClient
 
-	for i := 0; i < len(cb.clients); i++ {
-		c := <-ch
+	// accept returns true if c has the answer of question type
+	accept := func(c *RemoteClient) bool {
 		if c != nil && c.responseMessage != nil {
 			if common.HasType(c.responseMessage, c.questionMessage.Question[0].Qtype) {
 				ec = c
-				break
+				return true
 			}
 			if c.responseMessage.Answer != nil || common.HasSOA(c.responseMessage) {
 				fallbackc1 = c
@@ -70,6 +86,32 @@ func (cb *RemoteClientBundle) Exchange(isCache bool, isLog bool) *dns.Msg {
 			fallbackc2 = c
 			log.Debugf("DNSUpstream %s returned None answer, dropping it and wait the next one", c.dnsUpstream.Address)
 		}
+		return false
+	}
+
+	if order := cb.strategy.Order(clients); order != nil {
+		for _, c := range order {
+			c.Exchange(isLog)
+			// A response with answer or SOA is good enough, only fail over if the upstream has failed.
+			if accept(c) || fallbackc1 != nil {
+				break
+			}
+		}
+	} else {
+		ch := make(chan *RemoteClient, len(clients))
+
+		for _, o := range clients {
+			go func(c *RemoteClient, ch chan *RemoteClient) {
+				c.Exchange(isLog)
+				ch <- c
+			}(o, ch)
+		}
+
+		for i := 0; i < len(clients); i++ {
+			if accept(<-ch) {
+				break
+			}
+		}
 	}
 
 	if ec == nil && fallbackc1 != nil {
@@ -81,8 +123,11 @@ func (cb *RemoteClientBundle) Exchange(isCache bool, isLog bool) *dns.Msg {
 	if ec != nil {
 		cb.responseMessage = ec.responseMessage
 		cb.questionMessage = ec.questionMessage
+		cb.answeredUpstream = ec.dnsUpstream.Name
+		cb.ednsClientSubnetIP = common.GetEDNSClientSubnetIP(ec.questionMessage)
 
 		common.SetMinimumTTL(cb.responseMessage, uint32(cb.minimumTTL))
+		common.SetMaximumTTL(cb.responseMessage, uint32(cb.maximumTTL))
 		common.SetTTLByMap(cb.responseMessage, cb.domainTTLMap)
 
 		if isCache {
@@ -99,18 +144,36 @@ func (cb *RemoteClientBundle) ExchangeFromCache() *dns.Msg {
 	for _, o := range cb.clients {
 		cb.responseMessage = o.ExchangeFromCache()
 		if cb.responseMessage != nil {
+			cb.cacheHitKey = o.CacheKey()
+			cb.ednsClientSubnetIP = o.ednsClientSubnetIP
 			return cb.responseMessage
 		}
 	}
 	return cb.responseMessage
 }
 
+// ExchangeFromStaleCache returns the stale cached response of any client, it must be called before
+// the bundle is exchanged.
+func (cb *RemoteClientBundle) ExchangeFromStaleCache() *dns.Msg {
+	for _, o := range cb.clients {
+		if m := o.ExchangeFromStaleCache(); m != nil {
+			return m
+		}
+	}
+	return nil
+}
+
 func (cb *RemoteClientBundle) CacheResultIfNeeded() {
 	if cb.cache != nil && cb.responseMessage != nil && !common.IsEmptyAndNoSOA(cb.questionMessage, cb.responseMessage) {
 		cb.cache.InsertMessage(cache.Key(cb.questionMessage.Question[0], common.GetEDNSClientSubnetIP(cb.questionMessage)), cb.responseMessage, uint32(cb.minimumTTL))
 	}
 }
 
+// CacheHitKey returns the cache key of the response returned by ExchangeFromCache
+func (cb *RemoteClientBundle) CacheHitKey() string {
+	return cb.cacheHitKey
+}
+
 func (cb *RemoteClientBundle) IsType(t uint16) bool {
 	return t == cb.questionMessage.Question[0].Qtype
 }
@@ -122,3 +185,13 @@ func (cb *RemoteClientBundle) GetFirstQuestionDomain() string {
 func (cb *RemoteClientBundle) GetResponseMessage() *dns.Msg {
 	return cb.responseMessage
 }
+
+// GetAnsweredUpstream returns the name of the upstream whose response is used
+func (cb *RemoteClientBundle) GetAnsweredUpstream() string {
+	return cb.answeredUpstream
+}
+
+// GetEDNSClientSubnetIP returns the edns client subnet ip sent to the upstream, or in the cache key
+func (cb *RemoteClientBundle) GetEDNSClientSubnetIP() string {
+	return cb.ednsClientSubnetIP
+}
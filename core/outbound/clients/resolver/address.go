@@ -20,7 +20,7 @@ func getDefaultPort(protocol string) (port string) {
 	switch protocol {
 	case "udp", "tcp":
 		port = "53"
-	case "tcp-tls":
+	case "tcp-tls", "quic":
 		port = "853"
 	case "https":
 		port = "443"
@@ -33,7 +33,7 @@ func getDefaultPort(protocol string) (port string) {
 // ToNetwork convert dns protocol to network
 func ToNetwork(protocol string) string {
 	switch protocol {
-	case "udp":
+	case "udp", "quic":
 		return "udp"
 	case "tcp", "tcp-tls", "https":
 		return "tcp"
@@ -92,10 +92,13 @@ func extractTLSDNSAddress(rawAddress string, protocol string) (host string, port
 }
 
 func ExtractTLSDNSHostName(rawAddress string) (host string, err error) {
-	rawAddress = "tcp-tls" + "://" + rawAddress
+	return extractTLSDNSHostName(rawAddress, "tcp-tls")
+}
+
+func extractTLSDNSHostName(rawAddress string, protocol string) (host string, err error) {
 	s := strings.Split(rawAddress, "@")
 
-	host, _, err = extractUrl(s[0], "tcp-tls")
+	host, _, err = extractUrl(s[0], protocol)
 	return host, err
 }
 
@@ -118,6 +121,13 @@ func ExtractDNSAddress(rawAddress string, protocol string) (host string, port st
 	switch protocol {
 	case "tcp-tls":
 		host, port, err = extractTLSDNSAddress(rawAddress, protocol)
+	case "quic":
+		// quic accepts both "host:port@ip" and "host:port"
+		if strings.Contains(rawAddress, "@") {
+			host, port, err = extractTLSDNSAddress(strings.TrimPrefix(rawAddress, protocol+"://"), protocol)
+		} else {
+			host, port, err = extractUrl(rawAddress, protocol)
+		}
 	default:
 		host, port, err = extractUrl(rawAddress, protocol)
 	}
@@ -27,6 +27,10 @@ func TestExtractDNSAddress(t *testing.T) {
 		{"https://dns.google/dns-query", "https", "dns.google", "443", nil},
 		{"dns.google/dns-query", "https", "dns.google", "443", nil},
 		{"https://dns.google:888/dns-query", "https", "dns.google", "888", nil},
+		{"dns.adguard.com@" + ipv4Address, "quic", ipv4Address, "853", nil},
+		{"dns.adguard.com:784@" + ipv6Address, "quic", literalIpa6Address, "784", nil},
+		{"quic://dns.adguard.com:784", "quic", "dns.adguard.com", "784", nil},
+		{"dns.adguard.com", "quic", "dns.adguard.com", "853", nil},
 	}
 	for _, tt := range tests {
 		t.Run(tt.rawAddress+", "+tt.protocol, func(t *testing.T) {
@@ -6,7 +6,9 @@
 package resolver
 
 import (
+	"fmt"
 	"net"
+	"sort"
 	"time"
 
 	"github.com/miekg/dns"
@@ -69,29 +71,39 @@ func (r *BaseResolver) Init() error {
 	return nil
 }
 
-func NewResolver(u *common.DNSUpstream) Resolver {
-	var resolver Resolver
-	switch u.Protocol {
-	case "udp":
-		resolver = &UDPResolver{BaseResolver: BaseResolver{u}}
-	case "tcp":
-		resolver = &TCPResolver{BaseResolver: BaseResolver{u}}
-	case "tcp-tls":
-		resolver = &TCPTLSResolver{BaseResolver: BaseResolver{u}}
-	case "https":
-		resolver = &HTTPSResolver{BaseResolver: BaseResolver{u}}
-	default:
-		log.Fatalf("Unsupported protocol: %s", u.Protocol)
-		log.Errorf("Create resolver for %s failed", u.Name)
-		return nil
+// newResolverFuncs creates the resolver of each supported protocol
+var newResolverFuncs = map[string]func(b BaseResolver) Resolver{
+	"udp":     func(b BaseResolver) Resolver { return &UDPResolver{BaseResolver: b} },
+	"tcp":     func(b BaseResolver) Resolver { return &TCPResolver{BaseResolver: b} },
+	"tcp-tls": func(b BaseResolver) Resolver { return &TCPTLSResolver{BaseResolver: b} },
+	"https":   func(b BaseResolver) Resolver { return &HTTPSResolver{BaseResolver: b} },
+	"quic":    func(b BaseResolver) Resolver { return &QUICResolver{BaseResolver: b} },
+}
+
+// Protocols returns the protocols supported by NewResolver
+func Protocols() []string {
+	protocols := make([]string, 0, len(newResolverFuncs))
+	for p := range newResolverFuncs {
+		protocols = append(protocols, p)
+	}
+	sort.Strings(protocols)
+	return protocols
+}
+
+// NewResolver returns an error if the protocol of u is not supported
+func NewResolver(u *common.DNSUpstream) (Resolver, error) {
+	newResolver, ok := newResolverFuncs[u.Protocol]
+	if !ok {
+		return nil, fmt.Errorf("unsupported protocol %s of upstream %s", u.Protocol, u.Name)
 	}
+	resolver := newResolver(BaseResolver{u})
 	err := resolver.Init()
 	if err != nil {
 		log.Errorf("Init resolver for %s failed", u.Name)
 	} else {
 		log.Debugf("Init resolver for %s succeed", u.Name)
 	}
-	return resolver
+	return resolver, nil
 }
 
 func (r *BaseResolver) CreateBaseConn() (net.Conn, error) {
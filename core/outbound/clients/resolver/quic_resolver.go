@@ -0,0 +1,181 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// DoQ error codes, see RFC 9250 section 4.3
+const (
+	doqNoError       = 0x0
+	doqInternalError = 0x1
+)
+
+// QUICResolver implements DNS-over-QUIC (RFC 9250), a single connection is shared by all queries and
+// every query is sent on its own stream.
+type QUICResolver struct {
+	BaseResolver
+	tlsConfig *tls.Config
+
+	lock sync.Mutex
+	conn *quic.Conn
+}
+
+func (r *QUICResolver) Exchange(q *dns.Msg) (*dns.Msg, error) {
+	if r.dnsUpstream.SOCKS5Address != "" {
+		return nil, errors.New("SOCKS5 proxy is not supported by quic protocol")
+	}
+
+	conn, msg, err := r.exchangeWithTimeout(q)
+	if err != nil && conn != nil && isQUICConnError(conn, err) {
+		// The connection may be closed by server because of idle timeout, try once again with a new connection.
+		r.closeConn(conn, doqNoError)
+		_, msg, err = r.exchangeWithTimeout(q)
+	}
+	return msg, err
+}
+
+// exchangeWithTimeout sends q on a new stream of the shared connection, the connection is returned
+// even if the exchange fails.
+func (r *QUICResolver) exchangeWithTimeout(q *dns.Msg) (*quic.Conn, *dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.getDialTimeout())
+	defer cancel()
+
+	conn, err := r.getConn(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg, err := r.exchangeByConn(ctx, q, conn)
+	return conn, msg, err
+}
+
+// isQUICConnError returns true if err is caused by failure of conn. Errors of a single stream, such
+// as timeout of a query, must not close the connection shared by other queries.
+func isQUICConnError(conn *quic.Conn, err error) bool {
+	select {
+	case <-conn.Context().Done():
+		return true
+	default:
+	}
+	var idleTimeoutErr *quic.IdleTimeoutError
+	var statelessResetErr *quic.StatelessResetError
+	return errors.As(err, &idleTimeoutErr) || errors.As(err, &statelessResetErr)
+}
+
+func (r *QUICResolver) exchangeByConn(ctx context.Context, q *dns.Msg, conn *quic.Conn) (*dns.Msg, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+
+	// The message ID must be set to 0 when sending over QUIC.
+	id := q.Id
+	q = q.Copy()
+	q.Id = 0
+	buf, err := q.Pack()
+	if err != nil {
+		stream.CancelWrite(doqInternalError)
+		return nil, err
+	}
+	b := make([]byte, 2+len(buf))
+	binary.BigEndian.PutUint16(b, uint16(len(buf)))
+	copy(b[2:], buf)
+	if _, err = stream.Write(b); err != nil {
+		log.Warnf("%s Fail: Send question message failed", r.dnsUpstream.Name)
+		return nil, err
+	}
+	// Indicate that no more queries will be sent on this stream.
+	stream.Close()
+
+	msg, err := readQUICMsg(stream)
+	stream.CancelRead(doqNoError)
+	if err != nil {
+		return nil, err
+	}
+	msg.Id = id
+	return msg, nil
+}
+
+func readQUICMsg(r io.Reader) (*dns.Msg, error) {
+	var l uint16
+	if err := binary.Read(r, binary.BigEndian, &l); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, l)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(buf); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (r *QUICResolver) getConn(ctx context.Context) (*quic.Conn, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.conn != nil {
+		select {
+		case <-r.conn.Context().Done():
+			r.conn = nil
+		default:
+			return r.conn, nil
+		}
+	}
+
+	host, port, err := ExtractDNSAddress(r.dnsUpstream.Address, r.dnsUpstream.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	address := net.JoinHostPort(host, port)
+	log.Debugf("Creating new connection to %s", address)
+	conn, err := quic.DialAddr(ctx, address, r.tlsConfig, &quic.Config{
+		HandshakeIdleTimeout: r.getDialTimeout(),
+		MaxIdleTimeout:       IdleTimeout,
+	})
+	if err != nil {
+		log.Warnf("Failed to connect to DNS upstream: %s", err)
+		return nil, err
+	}
+	r.conn = conn
+	return conn, nil
+}
+
+func (r *QUICResolver) closeConn(conn *quic.Conn, code quic.ApplicationErrorCode) {
+	r.lock.Lock()
+	if r.conn == conn {
+		r.conn = nil
+	}
+	r.lock.Unlock()
+	conn.CloseWithError(code, "")
+}
+
+func (r *QUICResolver) Init() error {
+	err := r.BaseResolver.Init()
+	if err != nil {
+		return err
+	}
+	host, err := extractTLSDNSHostName(r.dnsUpstream.Address, r.dnsUpstream.Protocol)
+	if err != nil {
+		return err
+	}
+	r.tlsConfig = &tls.Config{
+		ServerName: host,
+		NextProtos: []string{"doq"},
+	}
+	return nil
+}
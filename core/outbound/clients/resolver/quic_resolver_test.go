@@ -0,0 +1,119 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+
+	"github.com/shawn1m/overture/core/common"
+	"github.com/shawn1m/overture/core/internal/testcert"
+)
+
+func TestQUICResolver(t *testing.T) {
+	cert, pool := testcert.Generate(t)
+	ln, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"doq"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveTestQUIC(ln)
+
+	u := &common.DNSUpstream{
+		Name:     "Test-QUIC",
+		Address:  "localhost:" + strconv.Itoa(ln.Addr().(*net.UDPAddr).Port) + "@127.0.0.1",
+		Protocol: "quic",
+		Timeout:  6,
+		EDNSClientSubnet: &common.EDNSClientSubnetType{
+			Policy: "disable",
+		},
+	}
+	resolver, err := NewResolver(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := resolver.(*QUICResolver)
+	r.tlsConfig.RootCAs = pool
+
+	var conn *quic.Conn
+	for i := 0; i < 3; i++ {
+		q := getQueryMsg(questionDomain, dns.TypeA)
+		q.Id = uint16(1000 + i)
+		resp, err := r.Exchange(q)
+		if err != nil {
+			t.Fatalf("Got error: %s", err)
+		}
+		if resp.Id != q.Id {
+			t.Errorf("got id %d, want %d", resp.Id, q.Id)
+		}
+		if common.FindRecordByType(resp, dns.TypeA) != "127.0.0.1" {
+			t.Error(questionDomain + " should be 127.0.0.1")
+		}
+		if conn != nil && conn != r.conn {
+			t.Error("connection should be reused")
+		}
+		conn = r.conn
+	}
+
+	// Failure of a stream should not close the connection shared by other queries.
+	if _, err := r.Exchange(getQueryMsg("fail.example.com.", dns.TypeA)); err == nil {
+		t.Error("exchange should fail if the stream is reset")
+	}
+	select {
+	case <-conn.Context().Done():
+		t.Error("connection should not be closed because of a stream error")
+	default:
+	}
+	if r.conn != conn {
+		t.Error("connection should be kept after a stream error")
+	}
+
+	// A closed connection should be replaced by a new one.
+	conn.CloseWithError(0, "")
+	<-conn.Context().Done()
+	if _, err := r.Exchange(getQueryMsg(questionDomain, dns.TypeA)); err != nil {
+		t.Errorf("Got error after reconnect: %s", err)
+	}
+	if r.conn == conn {
+		t.Error("connection should be recreated")
+	}
+}
+
+func serveTestQUIC(ln *quic.Listener) {
+	for {
+		conn, err := ln.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		go func() {
+			for {
+				stream, err := conn.AcceptStream(context.Background())
+				if err != nil {
+					return
+				}
+				go func() {
+					defer stream.Close()
+					q, err := readQUICMsg(stream)
+					if err != nil || q.Id != 0 || q.Question[0].Name == "fail.example.com." {
+						stream.CancelWrite(doqInternalError)
+						return
+					}
+					resp := new(dns.Msg)
+					resp.SetReply(q)
+					a, _ := dns.NewRR(q.Question[0].Name + " IN A 127.0.0.1")
+					resp.Answer = append(resp.Answer, a)
+					buf, _ := resp.Pack()
+					b := make([]byte, 2+len(buf))
+					binary.BigEndian.PutUint16(b, uint16(len(buf)))
+					copy(b[2:], buf)
+					stream.Write(b)
+				}()
+			}
+		}()
+	}
+}
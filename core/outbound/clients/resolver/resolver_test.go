@@ -75,7 +75,7 @@ func TestDispatcher(t *testing.T) {
 
 func testUDP(t *testing.T) {
 	q := getQueryMsg(questionDomain, dns.TypeA)
-	resolver := NewResolver(udpUpstream)
+	resolver, _ := NewResolver(udpUpstream)
 	resp, err := resolver.Exchange(q)
 	if err != nil {
 		t.Errorf("Got error: %s", err)
@@ -87,7 +87,7 @@ func testUDP(t *testing.T) {
 
 func testTCP(t *testing.T) {
 	q := getQueryMsg(questionDomain, dns.TypeA)
-	resolver := NewResolver(tcpUpstream)
+	resolver, _ := NewResolver(tcpUpstream)
 	resp, _ := resolver.Exchange(q)
 	if net.ParseIP(common.FindRecordByType(resp, dns.TypeA)).To4() == nil {
 		t.Error(questionDomain + " should have A record")
@@ -96,7 +96,7 @@ func testTCP(t *testing.T) {
 
 func testTCPTLS(t *testing.T) {
 	q := getQueryMsg(questionDomain, dns.TypeA)
-	resolver := NewResolver(tcpTlsUpstream)
+	resolver, _ := NewResolver(tcpTlsUpstream)
 	resp, _ := resolver.Exchange(q)
 	if net.ParseIP(common.FindRecordByType(resp, dns.TypeA)).To4() == nil {
 		t.Error(questionDomain + " should have A record")
@@ -105,7 +105,7 @@ func testTCPTLS(t *testing.T) {
 
 func testHTTPS(t *testing.T) {
 	q := getQueryMsg(questionDomain, dns.TypeA)
-	resolver := NewResolver(httpsUpstream)
+	resolver, _ := NewResolver(httpsUpstream)
 	resp, _ := resolver.Exchange(q)
 	if net.ParseIP(common.FindRecordByType(resp, dns.TypeA)).To4() == nil {
 		t.Error(questionDomain + " should have A record")
@@ -37,6 +37,6 @@ func (r *UDPResolver) Init() error {
 		Timeout:          r.dnsUpstream.Timeout,
 		EDNSClientSubnet: r.dnsUpstream.EDNSClientSubnet,
 	}
-	r.tcp = NewResolver(tcpupstream)
+	r.tcp = &TCPResolver{BaseResolver: BaseResolver{tcpupstream}}
 	return r.tcp.Init()
 }
@@ -0,0 +1,115 @@
+/*
+ * Copyright (c) 2019 shawn1m. All rights reserved.
+ * Use of this source code is governed by The MIT License (MIT) that can be
+ * found in the LICENSE file..
+ */
+
+package clients
+
+import (
+	"math/rand"
+	"sort"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Probability of trying upstreams in random order for "fastest" strategy, so that latency of slower
+// upstreams keeps being measured.
+const fastestExploreRate = 0.1
+
+// Strategy decides how a RemoteClientBundle queries its upstreams.
+type Strategy interface {
+	// Order returns clients in the order they should be tried one by one until one of them answers,
+	// or nil if all clients should be queried concurrently.
+	Order(cl []*RemoteClient) []*RemoteClient
+	Name() string
+}
+
+// newStrategyFuncs creates the strategy of each supported name
+var newStrategyFuncs = map[string]func() Strategy{
+	"parallel":    func() Strategy { return &ParallelStrategy{} },
+	"sequential":  func() Strategy { return &SequentialStrategy{} },
+	"round-robin": func() Strategy { return &RoundRobinStrategy{} },
+	"random":      func() Strategy { return &RandomStrategy{} },
+	"fastest":     func() Strategy { return &FastestStrategy{} },
+}
+
+// Strategies returns the names supported by NewStrategy, "" is not included
+func Strategies() []string {
+	names := make([]string, 0, len(newStrategyFuncs))
+	for name := range newStrategyFuncs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewStrategy returns the strategy by name, "parallel" is the default one.
+func NewStrategy(name string) Strategy {
+	if name == "" {
+		name = "parallel"
+	}
+	newStrategy, ok := newStrategyFuncs[name]
+	if !ok {
+		log.Warnf("Strategy %s does not exist, using parallel strategy as default", name)
+		return &ParallelStrategy{}
+	}
+	return newStrategy()
+}
+
+// ParallelStrategy queries all upstreams concurrently and takes the first typed answer.
+type ParallelStrategy struct{}
+
+func (s *ParallelStrategy) Order(cl []*RemoteClient) []*RemoteClient { return nil }
+func (s *ParallelStrategy) Name() string                             { return "parallel" }
+
+// SequentialStrategy tries upstreams in configured order, the next one is used only if the previous fails.
+type SequentialStrategy struct{}
+
+func (s *SequentialStrategy) Order(cl []*RemoteClient) []*RemoteClient { return cl }
+func (s *SequentialStrategy) Name() string                             { return "sequential" }
+
+// RoundRobinStrategy starts from the next upstream on every query.
+type RoundRobinStrategy struct {
+	next uint32
+}
+
+func (s *RoundRobinStrategy) Order(cl []*RemoteClient) []*RemoteClient {
+	if len(cl) == 0 {
+		return cl
+	}
+	i := int((atomic.AddUint32(&s.next, 1) - 1) % uint32(len(cl)))
+	return append(append(make([]*RemoteClient, 0, len(cl)), cl[i:]...), cl[:i]...)
+}
+func (s *RoundRobinStrategy) Name() string { return "round-robin" }
+
+// RandomStrategy tries upstreams in random order.
+type RandomStrategy struct{}
+
+func (s *RandomStrategy) Order(cl []*RemoteClient) []*RemoteClient { return shuffleClients(cl) }
+func (s *RandomStrategy) Name() string                             { return "random" }
+
+// FastestStrategy tries the upstream with the lowest observed latency first, upstreams which have
+// not been measured yet are tried before others.
+type FastestStrategy struct{}
+
+func (s *FastestStrategy) Order(cl []*RemoteClient) []*RemoteClient {
+	if rand.Float64() < fastestExploreRate {
+		return shuffleClients(cl)
+	}
+	ordered := append(make([]*RemoteClient, 0, len(cl)), cl...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].health.Latency() < ordered[j].health.Latency()
+	})
+	return ordered
+}
+func (s *FastestStrategy) Name() string { return "fastest" }
+
+func shuffleClients(cl []*RemoteClient) []*RemoteClient {
+	shuffled := append(make([]*RemoteClient, 0, len(cl)), cl...)
+	rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	return shuffled
+}
@@ -0,0 +1,88 @@
+package clients
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/shawn1m/overture/core/common"
+	"github.com/shawn1m/overture/core/outbound/clients/resolver"
+)
+
+func newTestClients(names ...string) []*RemoteClient {
+	var cl []*RemoteClient
+	for _, name := range names {
+		u := newTestUpstream(name)
+		cl = append(cl, &RemoteClient{dnsUpstream: u, health: NewUpstreamHealth(u, nil)})
+	}
+	return cl
+}
+
+func clientNames(cl []*RemoteClient) string {
+	var s string
+	for _, c := range cl {
+		s += c.dnsUpstream.Name
+	}
+	return s
+}
+
+func TestRoundRobinStrategy(t *testing.T) {
+	cl := newTestClients("a", "b", "c")
+	s := NewStrategy("round-robin")
+	for _, want := range []string{"abc", "bca", "cab", "abc"} {
+		if got := clientNames(s.Order(cl)); got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+	if clientNames(cl) != "abc" {
+		t.Error("original clients should not be modified")
+	}
+}
+
+func TestFastestStrategy(t *testing.T) {
+	cl := newTestClients("a", "b", "c")
+	cl[0].health.Report(30*time.Millisecond, nil)
+	cl[1].health.Report(10*time.Millisecond, nil)
+	cl[2].health.Report(20*time.Millisecond, nil)
+	s := NewStrategy("fastest")
+
+	fastest := 0
+	for i := 0; i < 100; i++ {
+		if clientNames(s.Order(cl)) == "bca" {
+			fastest++
+		}
+	}
+	// Random order is only used for exploration
+	if fastest < 70 {
+		t.Errorf("fastest order is only used %d times out of 100", fastest)
+	}
+}
+
+func TestSequentialStrategy(t *testing.T) {
+	ul := []*common.DNSUpstream{newTestUpstream("first"), newTestUpstream("second")}
+	first, second := &fakeResolver{}, &fakeResolver{}
+	healths := []*UpstreamHealth{NewUpstreamHealth(ul[0], first), NewUpstreamHealth(ul[1], second)}
+
+	exchange := func() *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		cb := NewClientBundle(q, ul, []resolver.Resolver{first, second}, healths, NewStrategy("sequential"), "", 0, 0, nil, "Test", nil)
+		return cb.Exchange(false, false)
+	}
+
+	if resp := exchange(); common.FindRecordByType(resp, dns.TypeA) != "127.0.0.1" {
+		t.Error("query should succeed")
+	}
+	if first.queries.Load() != 1 || second.queries.Load() != 0 {
+		t.Error("only the first upstream should be queried")
+	}
+
+	first.fail.Store(true)
+	if resp := exchange(); common.FindRecordByType(resp, dns.TypeA) != "127.0.0.1" {
+		t.Error("query should fail over to the second upstream")
+	}
+	if first.queries.Load() != 2 || second.queries.Load() != 1 {
+		t.Error("the second upstream should be queried after the first one failed")
+	}
+}
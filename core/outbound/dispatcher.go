@@ -1,7 +1,10 @@
 package outbound
 
 import (
+	"context"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/shawn1m/overture/core/outbound/clients/resolver"
@@ -11,243 +14,288 @@ import (
 	"github.com/shawn1m/overture/core/cache"
 	"github.com/shawn1m/overture/core/common"
 	"github.com/shawn1m/overture/core/hosts"
-	"github.com/shawn1m/overture/core/matcher"
+	"github.com/shawn1m/overture/core/metrics"
 	"github.com/shawn1m/overture/core/outbound/clients"
 )
 
 type Dispatcher struct {
-	PrimaryDNS     []*common.DNSUpstream
-	AlternativeDNS []*common.DNSUpstream
-	OnlyPrimaryDNS bool
-
-	WhenPrimaryDNSAnswerNoneUse string
-	IPNetworkPrimarySet         *common.IPSet
-	IPNetworkAlternativeSet     *common.IPSet
-	DomainPrimaryList           matcher.Matcher
-	DomainAlternativeList       matcher.Matcher
-	RedirectIPv6Record          bool
-	AlternativeDNSConcurrent    bool
+	UpstreamGroups []*common.UpstreamGroup
+	Rules          []*common.Rule
 
 	MinimumTTL   int
+	MaximumTTL   int
 	DomainTTLMap map[string]uint32
 
+	// Stale answer is served if the upstream group does not answer in StaleClientTimeout
+	StaleClientTimeout time.Duration
+
 	Hosts *hosts.Hosts
 	Cache *cache.Cache
 
-	primaryResolvers     []resolver.Resolver
-	alternativeResolvers []resolver.Resolver
+	groups []*upstreamGroup
+	cancel context.CancelFunc
+}
 
-	AlternativeFirst bool
+// upstreamGroup holds the runtime state of an UpstreamGroup
+type upstreamGroup struct {
+	*common.UpstreamGroup
+	resolvers []resolver.Resolver
+	healths   []*clients.UpstreamHealth
+	strategy  clients.Strategy
 }
 
-func createResolver(ul []*common.DNSUpstream) (resolvers []resolver.Resolver) {
+func createResolver(ul []*common.DNSUpstream) (resolvers []resolver.Resolver, err error) {
 	resolvers = make([]resolver.Resolver, len(ul))
 	for i, u := range ul {
-		resolvers[i] = resolver.NewResolver(u)
+		resolvers[i], err = resolver.NewResolver(u)
+		if err != nil {
+			return nil, err
+		}
 	}
-	return resolvers
+	return resolvers, nil
 }
 
-func (d *Dispatcher) Init() {
-	d.primaryResolvers = createResolver(d.PrimaryDNS)
-	d.alternativeResolvers = createResolver(d.AlternativeDNS)
-}
-
-func (d *Dispatcher) Exchange(query *dns.Msg, inboundIP string) *dns.Msg {
-	PrimaryClientBundle := clients.NewClientBundle(query, d.PrimaryDNS, d.primaryResolvers, inboundIP, d.MinimumTTL, d.Cache, "Primary", d.DomainTTLMap)
-	AlternativeClientBundle := clients.NewClientBundle(query, d.AlternativeDNS, d.alternativeResolvers, inboundIP, d.MinimumTTL, d.Cache, "Alternative", d.DomainTTLMap)
-
-	var ActiveClientBundle *clients.RemoteClientBundle
-
-	localClient := clients.NewLocalClient(query, d.Hosts, d.MinimumTTL, d.DomainTTLMap)
-	resp := localClient.Exchange()
-	if resp != nil {
-		querylog.Log(inboundIP, query, "Hosts")
-		return resp
+func createHealth(ul []*common.DNSUpstream, resolvers []resolver.Resolver) (healths []*clients.UpstreamHealth) {
+	healths = make([]*clients.UpstreamHealth, len(ul))
+	for i, u := range ul {
+		healths[i] = clients.NewUpstreamHealth(u, resolvers[i])
 	}
+	return healths
+}
 
-	for _, cb := range []*clients.RemoteClientBundle{PrimaryClientBundle, AlternativeClientBundle} {
-		resp := cb.ExchangeFromCache()
-		if resp != nil {
-			querylog.Log(inboundIP, query, "Cache")
-			return resp
+// Init creates resolvers of all upstream groups and starts health probing, it returns an error if an
+// upstream can not be created
+func (d *Dispatcher) Init() error {
+	d.groups = make([]*upstreamGroup, len(d.UpstreamGroups))
+	for i, g := range d.UpstreamGroups {
+		resolvers, err := createResolver(g.DNS)
+		if err != nil {
+			return err
+		}
+		d.groups[i] = &upstreamGroup{
+			UpstreamGroup: g,
+			resolvers:     resolvers,
+			healths:       createHealth(g.DNS, resolvers),
+			strategy:      clients.NewStrategy(g.Strategy),
 		}
 	}
 
-	if d.OnlyPrimaryDNS || d.isSelectDomain(PrimaryClientBundle, d.DomainPrimaryList) {
-		ActiveClientBundle = PrimaryClientBundle
-		querylog.Log(inboundIP, query, "Primary")
-		return ActiveClientBundle.Exchange(true, true)
+	var ctx context.Context
+	ctx, d.cancel = context.WithCancel(context.Background())
+	for _, g := range d.groups {
+		for _, h := range g.healths {
+			go h.RunProbe(ctx)
+		}
 	}
+	return nil
+}
 
-	if ok := d.isExchangeForIPv6(query) || d.isSelectDomain(AlternativeClientBundle, d.DomainAlternativeList); ok {
-		ActiveClientBundle = AlternativeClientBundle
-		querylog.Log(inboundIP, query, "Alternative")
-		return ActiveClientBundle.Exchange(true, true)
+// Stop active health probing
+func (d *Dispatcher) Stop() {
+	if d.cancel != nil {
+		d.cancel()
 	}
+}
 
-	if d.AlternativeFirst {
-		ActiveClientBundle = d.selectByIPNetwork_alterFirst(PrimaryClientBundle, AlternativeClientBundle)
-		if ActiveClientBundle == PrimaryClientBundle {
-			querylog.Log(inboundIP, query, "AlternativeThenPrimary")
-		} else {
-			querylog.Log(inboundIP, query, "Alternative")
-		}
-	} else {
-		ActiveClientBundle = d.selectByIPNetwork(PrimaryClientBundle, AlternativeClientBundle)
-		if ActiveClientBundle == PrimaryClientBundle {
-			querylog.Log(inboundIP, query, "Primary")
-		} else {
-			querylog.Log(inboundIP, query, "PrimaryThenAlternative")
+// HealthStatus returns the health status of all upstreams, grouped by upstream group name
+func (d *Dispatcher) HealthStatus() map[string][]clients.HealthStatus {
+	status := make(map[string][]clients.HealthStatus)
+	for _, g := range d.groups {
+		status[g.Name] = make([]clients.HealthStatus, 0, len(g.healths))
+		for _, h := range g.healths {
+			status[g.Name] = append(status[g.Name], h.Status())
 		}
 	}
-
-	// Only try to Cache result before return
-	ActiveClientBundle.CacheResultIfNeeded()
-	return ActiveClientBundle.GetResponseMessage()
+	return status
 }
 
-func (d *Dispatcher) isExchangeForIPv6(query *dns.Msg) bool {
-	if query.Question[0].Qtype == dns.TypeAAAA && d.RedirectIPv6Record {
-		log.Debug("Finally use alternative DNS")
-		return true
-	}
+// groupExchange makes sure an upstream group is queried at most once for a query, even if it is needed
+// by several rules or queried concurrently.
+type groupExchange struct {
+	once            sync.Once
+	clientBundle    *clients.RemoteClientBundle
+	responseMessage *dns.Msg
+	staleMessage    *dns.Msg
+}
 
-	return false
+func (e *groupExchange) exchange() *dns.Msg {
+	e.once.Do(func() {
+		e.responseMessage = e.clientBundle.Exchange(false, true)
+	})
+	return e.responseMessage
 }
 
-func (d *Dispatcher) isSelectDomain(rcb *clients.RemoteClientBundle, dt matcher.Matcher) bool {
-	if dt != nil {
-		qn := rcb.GetFirstQuestionDomain()
-
-		if dt.Has(qn) {
-			log.WithFields(log.Fields{
-				"DNS":      rcb.Name,
-				"question": qn,
-				"domain":   qn,
-			}).Debug("Matched")
-			log.Debugf("Finally use %s DNS", rcb.Name)
-			return true
-		}
+func (d *Dispatcher) Exchange(query *dns.Msg, inboundIP string) *dns.Msg {
+	return d.ExchangeWithEntry(query, inboundIP, querylog.NewEntry(inboundIP, query))
+}
 
-		log.Debugf("Domain %s match fail", rcb.Name)
-	} else {
-		log.Debug("Domain matcher is nil, not checking")
-	}
+// ExchangeWithEntry records how the query is answered in the query log entry
+func (d *Dispatcher) ExchangeWithEntry(query *dns.Msg, inboundIP string, entry *querylog.Entry) *dns.Msg {
+	return d.exchange(query, inboundIP, entry, false)
+}
 
-	return false
+// prefetch queries upstreams for a popular cached query and replaces the cache element with the key
+func (d *Dispatcher) prefetch(query *dns.Msg, inboundIP string, key string) {
+	defer d.Cache.PrefetchDone(key)
+	log.Debugf("Prefetch: %s", key)
+	d.exchange(query, inboundIP, querylog.NewEntry(inboundIP, query), true)
 }
 
-func (d *Dispatcher) selectByIPNetwork(PrimaryClientBundle, AlternativeClientBundle *clients.RemoteClientBundle) *clients.RemoteClientBundle {
-	primaryOut := make(chan *dns.Msg)
-	alternateOut := make(chan *dns.Msg)
-	go func() {
-		primaryOut <- PrimaryClientBundle.Exchange(false, true)
-	}()
-	alternateFunc := func() {
-		alternateOut <- AlternativeClientBundle.Exchange(false, true)
-	}
-	waitAlternateResp := func() {
-		if !d.AlternativeDNSConcurrent {
-			go alternateFunc()
+// exchange skips cache and metrics if isPrefetch is true
+func (d *Dispatcher) exchange(query *dns.Msg, inboundIP string, entry *querylog.Entry, isPrefetch bool) *dns.Msg {
+	localClient := clients.NewLocalClient(query, d.Hosts, d.MinimumTTL, d.MaximumTTL, d.DomainTTLMap)
+	resp := localClient.Exchange()
+	if resp != nil {
+		entry.Tag = "Hosts"
+		if !isPrefetch {
+			metrics.Query(query, "Hosts")
 		}
-		<-alternateOut
-	}
-	if d.AlternativeDNSConcurrent {
-		go alternateFunc()
+		return resp
 	}
-	primaryResponse := <-primaryOut
-
-	if primaryResponse != nil {
-		if primaryResponse.Answer == nil {
-			if d.WhenPrimaryDNSAnswerNoneUse != "AlternativeDNS" {
-				log.Debug("Primary DNS response has no answer section but exist, finally use PrimaryDNS")
-				return PrimaryClientBundle
-			} else {
-				log.Debug("Primary DNS response has no answer section but exist, finally use AlternativeDNS")
-				waitAlternateResp()
-				return AlternativeClientBundle
+
+	exchanges := make(map[string]*groupExchange, len(d.groups))
+	for _, g := range d.groups {
+		cb := clients.NewClientBundle(query, g.DNS, g.resolvers, g.healths, g.strategy, inboundIP, d.MinimumTTL, d.MaximumTTL, d.Cache, g.Name, d.DomainTTLMap)
+		exchanges[g.Name] = &groupExchange{clientBundle: cb}
+		if isPrefetch {
+			continue
+		}
+		resp := cb.ExchangeFromCache()
+		if resp != nil {
+			entry.Tag = "Cache"
+			entry.ECS = cb.GetEDNSClientSubnetIP()
+			metrics.Query(query, "Cache")
+			metrics.CacheHit(true)
+			if key := cb.CacheHitKey(); d.Cache.Prefetch(key) {
+				go d.prefetch(query.Copy(), inboundIP, key)
 			}
+			return resp
 		}
-	} else {
-		if d.WhenPrimaryDNSAnswerNoneUse != "AlternativeDNS" {
-			log.Debug("Primary DNS return nil, finally use PrimaryDNS")
-			return PrimaryClientBundle
-		} else {
-			log.Debug("Primary DNS return nil, finally use AlternativeDNS")
-			waitAlternateResp()
-			return AlternativeClientBundle
+		e := exchanges[g.Name]
+		if d.Cache.ServeStale() {
+			e.staleMessage = cb.ExchangeFromStaleCache()
 		}
 	}
 
-	for _, a := range PrimaryClientBundle.GetResponseMessage().Answer {
-		log.Debug("Try to match response ip address with IP network")
-		var ip net.IP
-		if a.Header().Rrtype == dns.TypeA {
-			ip = net.ParseIP(a.(*dns.A).A.String())
-		} else if a.Header().Rrtype == dns.TypeAAAA {
-			ip = net.ParseIP(a.(*dns.AAAA).AAAA.String())
-		} else {
+	if d.Cache != nil && !isPrefetch {
+		metrics.CacheHit(false)
+	}
+
+	for _, r := range d.Rules {
+		if !d.isMatchQuery(r, query, inboundIP) {
 			continue
 		}
-		if d.IPNetworkPrimarySet.Contains(ip, true, "primary") {
-			log.Debug("Finally use primary DNS")
-			return PrimaryClientBundle
+
+		if r.IPNetworkSet != nil {
+			if r.ConcurrentGroup != "" {
+				go exchanges[r.ConcurrentGroup].exchange()
+			}
+			answerFrom := r.AnswerFrom
+			if answerFrom == "" {
+				answerFrom = r.Group
+			}
+			resp := exchanges[answerFrom].exchange()
+			if resp == nil || resp.Answer == nil {
+				if r.WhenAnswerNone == "next" {
+					log.Debugf("%s DNS response has no answer section, try next rule", answerFrom)
+					continue
+				}
+				log.Debugf("%s DNS response has no answer section, finally use %s DNS", answerFrom, r.Group)
+			} else if !d.isMatchAnswer(r, resp) {
+				continue
+			}
 		}
-		if d.IPNetworkAlternativeSet.Contains(ip, true, "alternative") {
-			log.Debug("Finally use alternative DNS")
-			waitAlternateResp()
-			return AlternativeClientBundle
+
+		log.Debugf("Finally use %s DNS", r.Group)
+		entry.Tag = r.GetTag()
+		if !isPrefetch {
+			metrics.Query(query, r.GetTag())
 		}
+		return d.exchangeOrStale(exchanges[r.Group], entry)
 	}
-	log.Debug("IP network match failed, finally use alternative DNS")
-	waitAlternateResp()
-	return AlternativeClientBundle
+
+	log.Debugf("No rule matched: %s", query.Question[0].String())
+	return nil
 }
 
-func (d *Dispatcher) selectByIPNetwork_alterFirst(PrimaryClientBundle, AlternativeClientBundle *clients.RemoteClientBundle) *clients.RemoteClientBundle {
-	primaryOut := make(chan *dns.Msg)
-	alternateOut := make(chan *dns.Msg)
+// exchangeOrStale returns the response of the group. If there is a stale answer in cache, it is returned
+// when all upstreams of the group fail or do not answer in StaleClientTimeout, in the latter case the
+// cache is refreshed in background once the group answers.
+func (d *Dispatcher) exchangeOrStale(e *groupExchange, entry *querylog.Entry) *dns.Msg {
+	if e.staleMessage == nil {
+		resp := e.exchange()
+		// Only try to Cache result before return
+		e.clientBundle.CacheResultIfNeeded()
+		entry.Upstream = e.clientBundle.GetAnsweredUpstream()
+		entry.ECS = e.clientBundle.GetEDNSClientSubnetIP()
+		return resp
+	}
+
+	done := make(chan *dns.Msg, 1)
 	go func() {
-		alternateOut <- AlternativeClientBundle.Exchange(false, true)
+		resp := e.exchange()
+		e.clientBundle.CacheResultIfNeeded()
+		done <- resp
 	}()
-	primaryFunc := func() {
-		primaryOut <- PrimaryClientBundle.Exchange(false, true)
+
+	var timeout <-chan time.Time
+	if d.StaleClientTimeout > 0 {
+		timer := time.NewTimer(d.StaleClientTimeout)
+		defer timer.Stop()
+		timeout = timer.C
 	}
-	waitPrimaryResp := func() {
-		if !d.AlternativeDNSConcurrent {
-			go primaryFunc()
+
+	select {
+	case resp := <-done:
+		if resp != nil && resp.Rcode != dns.RcodeServerFailure {
+			entry.Upstream = e.clientBundle.GetAnsweredUpstream()
+			entry.ECS = e.clientBundle.GetEDNSClientSubnetIP()
+			return resp
 		}
-		<-primaryOut
-	}
-	if d.AlternativeDNSConcurrent {
-		go primaryFunc()
+		log.Debugf("All upstream of %s DNS failed, serve stale answer", e.clientBundle.Name)
+	case <-timeout:
+		log.Debugf("%s DNS does not answer in %s, serve stale answer and refresh in background", e.clientBundle.Name, d.StaleClientTimeout)
 	}
-	alterResponse := <-alternateOut
-
-	if alterResponse != nil {
-		if alterResponse.Answer == nil {
-			if d.WhenPrimaryDNSAnswerNoneUse != "AlternativeDNS" {
-				log.Debug("Alternative DNS response has no answer section but exist, finally use AlternativeDNS")
-				return AlternativeClientBundle
-			} else {
-				log.Debug("Alternative DNS response has no answer section but exist, finally use PrimaryDNS")
-				waitPrimaryResp()
-				return PrimaryClientBundle
+	entry.Stale = true
+	return e.staleMessage
+}
+
+func (d *Dispatcher) isMatchQuery(r *common.Rule, query *dns.Msg, inboundIP string) bool {
+	if len(r.QType) > 0 {
+		matched := false
+		for _, t := range r.QType {
+			if query.Question[0].Qtype == t {
+				matched = true
+				break
 			}
 		}
-	} else {
-		if d.WhenPrimaryDNSAnswerNoneUse != "AlternativeDNS" {
-			log.Debug("Alternative DNS return nil, finally use AlternativeDNS")
-			return AlternativeClientBundle
-		} else {
-			log.Debug("Alternative DNS return nil, finally use PrimaryDNS")
-			waitPrimaryResp()
-			return PrimaryClientBundle
+		if !matched {
+			return false
+		}
+	}
+
+	if r.ClientSubnetSet != nil && !r.ClientSubnetSet.Contains(net.ParseIP(inboundIP), false, "") {
+		return false
+	}
+
+	if r.DomainList != nil {
+		qn := query.Question[0].Name[:len(query.Question[0].Name)-1]
+		if !r.DomainList.Has(qn) {
+			log.Debugf("Domain %s match fail", r.Group)
+			return false
 		}
+		log.WithFields(log.Fields{
+			"DNS":      r.Group,
+			"question": qn,
+			"domain":   qn,
+		}).Debug("Matched")
 	}
 
-	for _, a := range AlternativeClientBundle.GetResponseMessage().Answer {
+	return true
+}
+
+func (d *Dispatcher) isMatchAnswer(r *common.Rule, resp *dns.Msg) bool {
+	for _, a := range resp.Answer {
 		log.Debug("Try to match response ip address with IP network")
 		var ip net.IP
 		if a.Header().Rrtype == dns.TypeA {
@@ -257,16 +305,13 @@ func (d *Dispatcher) selectByIPNetwork_alterFirst(PrimaryClientBundle, Alternati
 		} else {
 			continue
 		}
-		if d.IPNetworkAlternativeSet.Contains(ip, true, "alternative") {
-			log.Debug("Finally use alternative DNS")
-			return AlternativeClientBundle
+		if r.IPNetworkSet.Contains(ip, true, r.Group) {
+			return true
 		}
-		if d.IPNetworkPrimarySet.Contains(ip, true, "primary") {
-			log.Debug("Finally use primary DNS")
-			waitPrimaryResp()
-			return PrimaryClientBundle
+		if r.ExceptIPNetworkSet != nil && r.ExceptIPNetworkSet.Contains(ip, true, "except "+r.Group) {
+			break
 		}
 	}
-	log.Debug("IP network match failed, finally use alternative DNS")
-	return AlternativeClientBundle
+	log.Debugf("IP network %s match failed", r.Group)
+	return false
 }
@@ -19,24 +19,15 @@ func init() {
 	os.Chdir("../..")
 	conf := config.NewConfig("config.test.json")
 	dispatcher = Dispatcher{
-		PrimaryDNS:                  conf.PrimaryDNS,
-		AlternativeDNS:              conf.AlternativeDNS,
-		OnlyPrimaryDNS:              conf.OnlyPrimaryDNS,
-		WhenPrimaryDNSAnswerNoneUse: conf.WhenPrimaryDNSAnswerNoneUse,
-		IPNetworkPrimarySet:         conf.IPNetworkPrimarySet,
-		IPNetworkAlternativeSet:     conf.IPNetworkAlternativeSet,
-		DomainPrimaryList:           conf.DomainPrimaryList,
-		DomainAlternativeList:       conf.DomainAlternativeList,
-
-		RedirectIPv6Record:       conf.IPv6UseAlternativeDNS,
-		AlternativeDNSConcurrent: conf.AlternativeDNSConcurrent,
-		MinimumTTL:               conf.MinimumTTL,
-		DomainTTLMap:             conf.DomainTTLMap,
+		UpstreamGroups: conf.UpstreamGroups,
+		Rules:          conf.Rules,
+
+		MinimumTTL:   conf.MinimumTTL,
+		MaximumTTL:   conf.MaximumTTL,
+		DomainTTLMap: conf.DomainTTLMap,
 
 		Hosts: conf.Hosts,
 		Cache: conf.Cache,
-
-		AlternativeFirst: conf.AlternativeFirst,
 	}
 	dispatcher.Init()
 }
@@ -0,0 +1,46 @@
+package outbound
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/shawn1m/overture/core/cache"
+	"github.com/shawn1m/overture/core/common"
+)
+
+func TestDispatcherPrefetch(t *testing.T) {
+	c := cache.New(10, 0, 0)
+	defer c.Close()
+	c.SetPrefetch(50, 1)
+
+	r := &fakeResolver{ip: "1.1.1.1"}
+	d := newTestDispatcher(&Dispatcher{
+		Rules: []*common.Rule{{Group: "Test"}},
+		Cache: c,
+	}, map[string]*fakeResolver{"Test": r})
+	defer d.Stop()
+
+	const clientIP = "8.8.8.8"
+	key := cache.Key(dns.Question{Name: "prefetch.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, clientIP)
+	exchange := func() string {
+		q := new(dns.Msg)
+		q.SetQuestion("prefetch.example.", dns.TypeA)
+		return common.FindRecordByType(d.Exchange(q, clientIP), dns.TypeA)
+	}
+
+	// TTL of the answer is 1 second
+	if got := exchange(); got != "1.1.1.1" {
+		t.Fatalf("got %s, want 1.1.1.1", got)
+	}
+	r.ip = "2.2.2.2"
+	time.Sleep(600 * time.Millisecond)
+	if got := exchange(); got != "1.1.1.1" {
+		t.Errorf("cached answer should be returned, got %s", got)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if m := c.Hit(key, 0); common.FindRecordByType(m, dns.TypeA) != "2.2.2.2" {
+		t.Errorf("cache element %s should be prefetched", key)
+	}
+}
@@ -0,0 +1,141 @@
+package outbound
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/shawn1m/overture/core/common"
+	matcherfull "github.com/shawn1m/overture/core/matcher/full"
+	"github.com/shawn1m/overture/core/outbound/clients/resolver"
+)
+
+// fakeResolver answers every A query with ip and TTL 1 after delay, or fails
+type fakeResolver struct {
+	ip    string
+	fail  bool
+	delay time.Duration
+}
+
+func (r *fakeResolver) Init() error { return nil }
+
+func (r *fakeResolver) Exchange(q *dns.Msg) (*dns.Msg, error) {
+	time.Sleep(r.delay)
+	if r.fail {
+		return nil, errors.New("upstream failed")
+	}
+	m := new(dns.Msg)
+	m.SetReply(q)
+	if r.ip != "" {
+		a, _ := dns.NewRR(q.Question[0].Name + " 1 IN A " + r.ip)
+		m.Answer = append(m.Answer, a)
+	}
+	return m, nil
+}
+
+// newTestDispatcher initiates d with a group of one upstream for every resolver, named as the key
+func newTestDispatcher(d *Dispatcher, resolvers map[string]*fakeResolver) *Dispatcher {
+	for name := range resolvers {
+		u := &common.DNSUpstream{Name: name, Protocol: "udp", Address: "127.0.0.1", EDNSClientSubnet: &common.EDNSClientSubnetType{Policy: "auto"}}
+		d.UpstreamGroups = append(d.UpstreamGroups, &common.UpstreamGroup{Name: name, DNS: []*common.DNSUpstream{u}})
+	}
+	d.Init()
+	for _, g := range d.groups {
+		g.resolvers = []resolver.Resolver{resolvers[g.Name]}
+	}
+	return d
+}
+
+func newRuleTestDispatcher(rules []*common.Rule, answers map[string]string) *Dispatcher {
+	resolvers := map[string]*fakeResolver{}
+	for _, name := range []string{"Corp", "DNSPod", "Cloudflare"} {
+		resolvers[name] = &fakeResolver{ip: answers[name]}
+	}
+	return newTestDispatcher(&Dispatcher{Rules: rules}, resolvers)
+}
+
+func TestDispatcherRules(t *testing.T) {
+	corpList := &matcherfull.Map{DataMap: map[string]struct{}{"corp.example": {}}}
+	_, cnNet, _ := net.ParseCIDR("1.0.0.0/8")
+	_, lanNet, _ := net.ParseCIDR("192.168.0.0/16")
+
+	rules := []*common.Rule{
+		{Group: "Corp", DomainList: corpList},
+		{Group: "DNSPod", QType: []uint16{dns.TypeAAAA}},
+		{Group: "DNSPod", IPNetworkSet: common.NewIPSet([]*net.IPNet{cnNet}), WhenAnswerNone: "next", ConcurrentGroup: "Cloudflare"},
+		{Group: "Cloudflare"},
+	}
+
+	var tests = []struct {
+		name     string
+		qtype    uint16
+		clientIP string
+		answers  map[string]string
+		want     string
+	}{
+		{"corp.example.", dns.TypeA, "", map[string]string{"Corp": "10.0.0.1", "DNSPod": "1.1.1.1", "Cloudflare": "2.2.2.2"}, "10.0.0.1"},
+		{"v6.example.", dns.TypeAAAA, "", map[string]string{"Corp": "10.0.0.1", "DNSPod": "3.3.3.3", "Cloudflare": "2.2.2.2"}, "3.3.3.3"},
+		{"cn.example.", dns.TypeA, "", map[string]string{"Corp": "10.0.0.1", "DNSPod": "1.1.1.1", "Cloudflare": "2.2.2.2"}, "1.1.1.1"},
+		{"foreign.example.", dns.TypeA, "", map[string]string{"Corp": "10.0.0.1", "DNSPod": "3.3.3.3", "Cloudflare": "2.2.2.2"}, "2.2.2.2"},
+		{"empty.example.", dns.TypeA, "", map[string]string{"Corp": "10.0.0.1", "Cloudflare": "2.2.2.2"}, "2.2.2.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newRuleTestDispatcher(rules, tt.answers)
+			defer d.Stop()
+			q := new(dns.Msg)
+			q.SetQuestion(tt.name, tt.qtype)
+			resp := d.Exchange(q, tt.clientIP)
+			if resp == nil {
+				t.Fatal("response should not be nil")
+			}
+			if got := common.FindRecordByType(resp, dns.TypeA); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// Client subnet rule
+	d := newRuleTestDispatcher([]*common.Rule{
+		{Group: "Corp", ClientSubnetSet: common.NewIPSet([]*net.IPNet{lanNet})},
+		{Group: "Cloudflare"},
+	}, map[string]string{"Corp": "10.0.0.1", "Cloudflare": "2.2.2.2"})
+	defer d.Stop()
+	for clientIP, want := range map[string]string{"192.168.1.1": "10.0.0.1", "8.8.8.8": "2.2.2.2"} {
+		q := new(dns.Msg)
+		q.SetQuestion("lan.example.", dns.TypeA)
+		if got := common.FindRecordByType(d.Exchange(q, clientIP), dns.TypeA); got != want {
+			t.Errorf("client %s: got %s, want %s", clientIP, got, want)
+		}
+	}
+}
+
+func TestIsMatchAnswerOrder(t *testing.T) {
+	_, primaryNet, _ := net.ParseCIDR("1.0.0.0/8")
+	_, alternativeNet, _ := net.ParseCIDR("2.0.0.0/8")
+	r := &common.Rule{
+		Group:              "Primary",
+		IPNetworkSet:       common.NewIPSet([]*net.IPNet{primaryNet}),
+		ExceptIPNetworkSet: common.NewIPSet([]*net.IPNet{alternativeNet}),
+	}
+	d := &Dispatcher{}
+	for answers, want := range map[string]bool{
+		"3.3.3.3 1.1.1.1": true,
+		"2.2.2.2 1.1.1.1": false,
+		"1.1.1.1 2.2.2.2": true,
+		"3.3.3.3":         false,
+	} {
+		m := new(dns.Msg)
+		for _, ip := range strings.Fields(answers) {
+			a, _ := dns.NewRR("example.com. IN A " + ip)
+			m.Answer = append(m.Answer, a)
+		}
+		if got := d.isMatchAnswer(r, m); got != want {
+			t.Errorf("answers %s: got %v, want %v", answers, got, want)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package outbound
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/shawn1m/overture/core/cache"
+	"github.com/shawn1m/overture/core/common"
+)
+
+func TestDispatcherServeStale(t *testing.T) {
+	c := cache.New(10, 0, time.Hour)
+	defer c.Close()
+
+	r := &fakeResolver{ip: "1.1.1.1"}
+	d := newTestDispatcher(&Dispatcher{
+		Rules:              []*common.Rule{{Group: "Test"}},
+		Cache:              c,
+		StaleClientTimeout: 50 * time.Millisecond,
+	}, map[string]*fakeResolver{"Test": r})
+	defer d.Stop()
+
+	exchange := func() string {
+		q := new(dns.Msg)
+		q.SetQuestion("stale.example.", dns.TypeA)
+		return common.FindRecordByType(d.Exchange(q, ""), dns.TypeA)
+	}
+
+	if got := exchange(); got != "1.1.1.1" {
+		t.Fatalf("got %s, want 1.1.1.1", got)
+	}
+	time.Sleep(1100 * time.Millisecond)
+
+	r.fail = true
+	if got := exchange(); got != "1.1.1.1" {
+		t.Errorf("stale answer should be served when upstream fails, got %s", got)
+	}
+
+	// Slow upstream, the stale answer is served and the cache is refreshed in background
+	r.fail, r.ip, r.delay = false, "2.2.2.2", 200*time.Millisecond
+	if got := exchange(); got != "1.1.1.1" {
+		t.Errorf("stale answer should be served when upstream is slow, got %s", got)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if m := c.Hit(cache.Key(dns.Question{Name: "stale.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, ""), 0); common.FindRecordByType(m, dns.TypeA) != "2.2.2.2" {
+		t.Error("cache should be refreshed in background")
+	}
+}
@@ -1,24 +1,156 @@
 package querylog
 
 import (
+	"encoding/json"
 	"log"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 )
 
 var logger *log.Logger = log.New(os.Stdout, "", log.Ldate|log.Ltime)
 
-func SetQueryLogFile(filename string) error {
-	logfile, err := os.Create(filename)
+var (
+	formatLock sync.RWMutex
+	isJSON     bool
+
+	writerLock sync.Mutex
+	writer     *rotateWriter
+
+	tailLock  sync.Mutex
+	tail      [tailSize]*Entry
+	tailCount int
+)
+
+// Number of latest entries kept in memory for Tail
+const tailSize = 200
+
+// SetQueryLogFile appends query log to filename, the file is rotated as options. The previous file is closed.
+func SetQueryLogFile(filename string, options RotateOptions) error {
+	writerLock.Lock()
+	defer writerLock.Unlock()
+	// Keep the writer on reload, so the time to rotate by interval is kept
+	if writer != nil && writer.filename == filename && writer.options == options {
+		return nil
+	}
+	w, err := newRotateWriter(filename, options)
 	if err != nil {
 		return err
 	}
-	logger.SetOutput(logfile)
+	logger.SetOutput(w)
+	if writer != nil {
+		writer.Close()
+	}
+	writer = w
 	return nil
 }
 
-func Log(ip string, query *dns.Msg, tag string) {
-	logger.Printf("%s %s %s [%s]\n", ip, strings.TrimRight(query.Question[0].Name, "."), dns.Type(query.Question[0].Qtype).String(), tag)
+// Reopen the query log file, it is used after the file is moved by external tools such as logrotate
+func Reopen() error {
+	writerLock.Lock()
+	defer writerLock.Unlock()
+	if writer == nil {
+		return nil
+	}
+	return writer.Reopen()
+}
+
+// SetFormat sets the format of query log, "text" (default) or "json" for JSON lines
+func SetFormat(format string) {
+	formatLock.Lock()
+	defer formatLock.Unlock()
+	isJSON = format == "json"
+	if isJSON {
+		logger.SetFlags(0)
+	} else {
+		logger.SetFlags(log.Ldate | log.Ltime)
+	}
+}
+
+// Entry records how a query is answered
+type Entry struct {
+	Time     time.Time `json:"time"`
+	ClientIP string    `json:"client_ip"`
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Tag      string    `json:"tag"`
+	Rcode    string    `json:"rcode"`
+	Answers  []string  `json:"answers,omitempty"`
+	Upstream string    `json:"upstream,omitempty"`
+	Latency  float64   `json:"latency_ms"`
+	ECS      string    `json:"ecs,omitempty"`
+	Stale    bool      `json:"stale,omitempty"`
+	// Block or replace rule which fired
+	Rule string `json:"rule,omitempty"`
+}
+
+// NewEntry starts recording a query from ip
+func NewEntry(ip string, query *dns.Msg) *Entry {
+	return &Entry{
+		Time:     time.Now(),
+		ClientIP: ip,
+		Name:     strings.TrimRight(query.Question[0].Name, "."),
+		Type:     dns.Type(query.Question[0].Qtype).String(),
+	}
+}
+
+// SetResponse records the rcode and answers of the response, and the latency since the entry was created
+func (e *Entry) SetResponse(resp *dns.Msg) {
+	e.Latency = float64(time.Since(e.Time).Microseconds()) / 1000
+	if resp == nil {
+		e.Rcode = dns.RcodeToString[dns.RcodeServerFailure]
+		return
+	}
+	e.Rcode = dns.RcodeToString[resp.Rcode]
+	for _, a := range resp.Answer {
+		e.Answers = append(e.Answers, strings.Join(strings.Split(a.String(), "\t"), " "))
+	}
+}
+
+// AddRule records a block or replace rule which fired
+func (e *Entry) AddRule(rule string) {
+	if e.Rule != "" {
+		e.Rule += "; "
+	}
+	e.Rule += rule
+}
+
+// Write the entry to query log
+func Write(e *Entry) {
+	tailLock.Lock()
+	tail[tailCount%tailSize] = e
+	tailCount++
+	tailLock.Unlock()
+
+	formatLock.RLock()
+	defer formatLock.RUnlock()
+	if !isJSON {
+		logger.Printf("%s %s %s [%s]\n", e.ClientIP, e.Name, e.Type, e.Tag)
+		return
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	logger.Println(string(b))
+}
+
+// Tail returns at most n latest entries, from the newest one
+func Tail(n int) []*Entry {
+	tailLock.Lock()
+	defer tailLock.Unlock()
+	if n <= 0 || n > tailSize {
+		n = tailSize
+	}
+	if n > tailCount {
+		n = tailCount
+	}
+	entries := make([]*Entry, 0, n)
+	for i := 1; i <= n; i++ {
+		entries = append(entries, tail[(tailCount-i)%tailSize])
+	}
+	return entries
 }
@@ -0,0 +1,83 @@
+package querylog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestWrite(t *testing.T) {
+	var buf bytes.Buffer
+	logger.SetOutput(&buf)
+	defer logger.SetOutput(os.Stdout)
+	defer SetFormat("text")
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(q)
+	a, _ := dns.NewRR("example.com. 60 IN A 127.0.0.1")
+	resp.Answer = append(resp.Answer, a)
+
+	e := NewEntry("192.168.1.1", q)
+	e.Tag = "Primary"
+	e.Upstream = "Google"
+	e.ECS = "1.2.3.4"
+	e.AddRule("replace domain example.net")
+	e.AddRule("block ip 127.0.0.2")
+	e.SetResponse(resp)
+
+	Write(e)
+	if got := buf.String(); !strings.HasSuffix(got, "192.168.1.1 example.com A [Primary]\n") {
+		t.Errorf("unexpected text log: %s", got)
+	}
+
+	buf.Reset()
+	SetFormat("json")
+	Write(e)
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("query log should be JSON: %s", err)
+	}
+	for k, want := range map[string]interface{}{
+		"client_ip": "192.168.1.1",
+		"name":      "example.com",
+		"type":      "A",
+		"tag":       "Primary",
+		"rcode":     "NOERROR",
+		"upstream":  "Google",
+		"ecs":       "1.2.3.4",
+		"rule":      "replace domain example.net; block ip 127.0.0.2",
+	} {
+		if got[k] != want {
+			t.Errorf("%s is %v, want %v", k, got[k], want)
+		}
+	}
+	if answers, _ := got["answers"].([]interface{}); len(answers) != 1 || answers[0] != "example.com. 60 IN A 127.0.0.1" {
+		t.Errorf("unexpected answers: %v", got["answers"])
+	}
+}
+
+func TestTail(t *testing.T) {
+	logger.SetOutput(io.Discard)
+	defer logger.SetOutput(os.Stdout)
+
+	q := new(dns.Msg)
+	for i := 0; i < tailSize+10; i++ {
+		q.SetQuestion(strconv.Itoa(i)+".example.com.", dns.TypeA)
+		Write(NewEntry("192.168.1.1", q))
+	}
+	entries := Tail(3)
+	if len(entries) != 3 || entries[0].Name != strconv.Itoa(tailSize+9)+".example.com" || entries[2].Name != strconv.Itoa(tailSize+7)+".example.com" {
+		t.Errorf("unexpected tail: %v", entries)
+	}
+	if entries := Tail(0); len(entries) != tailSize || entries[tailSize-1].Name != "10.example.com" {
+		t.Errorf("tail should keep %d entries, got %d", tailSize, len(entries))
+	}
+}
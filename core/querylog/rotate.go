@@ -0,0 +1,210 @@
+package querylog
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Suffix format of rotated files, sortable by time
+const backupTimeFormat = "20060102-150405.000"
+
+// RotateOptions decides when the query log file is rotated and how many rotated files are kept.
+// Zero value means no rotation.
+type RotateOptions struct {
+	// Rotate when the file is larger than MaxSize bytes
+	MaxSize int64
+	// Rotate when the file has been written for Interval
+	Interval time.Duration
+	// Number of rotated files to keep, zero means keeping all of them
+	MaxBackups int
+	// Compress rotated files with gzip
+	Compress bool
+}
+
+// rotateWriter is an io.Writer appending to a file, which is rotated by size and time.
+type rotateWriter struct {
+	lock     sync.Mutex
+	filename string
+	options  RotateOptions
+	file     *os.File
+	size     int64
+	info     os.FileInfo
+	// Time the file is created, or first opened by this process
+	openTime time.Time
+
+	// Serialize compressing and removing rotated files
+	millLock sync.Mutex
+}
+
+func newRotateWriter(filename string, options RotateOptions) (*rotateWriter, error) {
+	w := &rotateWriter{filename: filename, options: options}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Must be called under the lock.
+func (w *rotateWriter) open() error {
+	f, err := os.OpenFile(w.filename, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.size = info.Size()
+	// Reopening the same file does not delay rotation by interval
+	if w.info == nil || !os.SameFile(w.info, info) {
+		w.openTime = time.Now()
+	}
+	w.info = info
+	return nil
+}
+
+func (w *rotateWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	}
+	if w.shouldRotate(len(p)) {
+		if err := w.rotate(); err != nil {
+			log.Warnf("Failed to rotate query log: %s", err)
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *rotateWriter) shouldRotate(n int) bool {
+	if w.size == 0 {
+		return false
+	}
+	if w.options.MaxSize > 0 && w.size+int64(n) > w.options.MaxSize {
+		return true
+	}
+	return w.options.Interval > 0 && time.Since(w.openTime) >= w.options.Interval
+}
+
+// Must be called under the lock.
+func (w *rotateWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.file = nil
+	backup := w.filename + "." + time.Now().Format(backupTimeFormat)
+	if err := os.Rename(w.filename, backup); err != nil {
+		return err
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+	go w.mill(backup)
+	return nil
+}
+
+// mill compresses the rotated file and removes old ones
+func (w *rotateWriter) mill(backup string) {
+	w.millLock.Lock()
+	defer w.millLock.Unlock()
+
+	if w.options.Compress {
+		if err := compressFile(backup); err != nil {
+			log.Warnf("Failed to compress query log %s: %s", backup, err)
+		}
+	}
+
+	if w.options.MaxBackups <= 0 {
+		return
+	}
+	backups := w.backups()
+	if len(backups) <= w.options.MaxBackups {
+		return
+	}
+	for _, f := range backups[:len(backups)-w.options.MaxBackups] {
+		if err := os.Remove(f); err != nil {
+			log.Warnf("Failed to remove query log %s: %s", f, err)
+		}
+	}
+}
+
+// backups returns rotated files from the oldest one
+func (w *rotateWriter) backups() []string {
+	matches, _ := filepath.Glob(w.filename + ".*")
+	var backups []string
+	for _, m := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(m, w.filename+"."), ".gz")
+		if _, err := time.Parse(backupTimeFormat, suffix); err == nil {
+			backups = append(backups, m)
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return strings.TrimSuffix(backups[i], ".gz") < strings.TrimSuffix(backups[j], ".gz")
+	})
+	return backups
+}
+
+func compressFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	_, err = io.Copy(gz, src)
+	if err == nil {
+		err = gz.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	src.Close()
+	return os.Remove(name)
+}
+
+// Reopen closes the file and opens it again, for rotation by external tools
+func (w *rotateWriter) Reopen() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+	return w.open()
+}
+
+func (w *rotateWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
@@ -0,0 +1,113 @@
+package querylog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotateWriter(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "query.log")
+	if err := ioutil.WriteFile(filename, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := newRotateWriter(filename, RotateOptions{MaxSize: 10, MaxBackups: 2, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// Existing content is kept
+	w.Write([]byte("12345\n"))
+	if b, _ := ioutil.ReadFile(filename); string(b) != "old\n12345\n" {
+		t.Errorf("log should be appended, got %q", b)
+	}
+
+	for i := 0; i < 4; i++ {
+		time.Sleep(2 * time.Millisecond)
+		w.Write([]byte("abcdefgh\n"))
+	}
+	// Wait for the last mill goroutine
+	time.Sleep(50 * time.Millisecond)
+	w.millLock.Lock()
+	backups := w.backups()
+	w.millLock.Unlock()
+
+	if len(backups) != 2 {
+		t.Fatalf("2 backups should be kept, got %v", backups)
+	}
+	for _, b := range backups {
+		if !strings.HasSuffix(b, ".gz") {
+			t.Errorf("backup %s should be compressed", b)
+		}
+	}
+	if b, _ := ioutil.ReadFile(filename); string(b) != "abcdefgh\n" {
+		t.Errorf("current log is %q", b)
+	}
+}
+
+func TestRotateWriterReopen(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "query.log")
+	w, err := newRotateWriter(filename, RotateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	w.Write([]byte("first\n"))
+	os.Rename(filename, filename+".1")
+	if err := w.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("second\n"))
+
+	if b, _ := ioutil.ReadFile(filename); string(b) != "second\n" {
+		t.Errorf("log should be written to the new file, got %q", b)
+	}
+	if b, _ := ioutil.ReadFile(filename + ".1"); string(b) != "first\n" {
+		t.Errorf("moved log is %q", b)
+	}
+}
+
+func TestRotateWriterKeepOpenTime(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "query.log")
+	options := RotateOptions{Interval: time.Hour}
+	if err := SetQueryLogFile(filename, options); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		logger.SetOutput(os.Stdout)
+		writer.Close()
+		writer = nil
+	}()
+	w := writer
+	openTime := w.openTime
+	time.Sleep(2 * time.Millisecond)
+
+	if err := SetQueryLogFile(filename, options); err != nil {
+		t.Fatal(err)
+	}
+	if writer != w {
+		t.Error("writer should be kept if the file and options are not changed")
+	}
+	if err := Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	if !w.openTime.Equal(openTime) {
+		t.Error("reopening the same file should not reset the time to rotate")
+	}
+
+	os.Rename(filename, filename+".1")
+	if err := Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	if w.openTime.Equal(openTime) {
+		t.Error("the time to rotate should be reset for a new file")
+	}
+}
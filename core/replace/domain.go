@@ -29,6 +29,17 @@ func NewDomainReplace(path string, finder finder.Finder) (*DomainReplace, error)
 	return r, nil
 }
 
+// NewDomainReplaceFromLines returns domain replace list parsed from lines in the format of replace file
+func NewDomainReplaceFromLines(lines []string, finder finder.Finder) *DomainReplace {
+	r := &DomainReplace{finder: finder}
+	for _, line := range lines {
+		if err := r.parseLine(line); err != nil {
+			log.Warnf("Bad formatted replace line: %s", err)
+		}
+	}
+	return r
+}
+
 func (r *DomainReplace) Find(name string) string {
 	name = strings.TrimSuffix(name, ".")
 	lines := r.finder.Get(name)
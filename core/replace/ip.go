@@ -36,6 +36,17 @@ func NewIPReplace(path string, finder finder.Finder) (*IPReplace, error) {
 	return r, nil
 }
 
+// NewIPReplaceFromLines returns IP replace list parsed from lines in the format of replace file
+func NewIPReplaceFromLines(lines []string) *IPReplace {
+	r := &IPReplace{lines: make([]*ipLine, 0)}
+	for _, line := range lines {
+		if err := r.parseLine(line); err != nil {
+			log.Warnf("Bad formatted replace line: %s", err)
+		}
+	}
+	return r
+}
+
 func (r *IPReplace) Find(ip net.IP) net.IP {
 	for _, i := range r.lines {
 		if i.ipset.Contains(ip, false, "IPReplace") {
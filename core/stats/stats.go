@@ -0,0 +1,244 @@
+// Copyright (c) 2016 shawn1m. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Package stats keeps query statistics in memory over a rolling window of hours.
+package stats
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWindow = 24
+	defaultTopN   = 10
+	// Max number of distinct domains or clients counted in an hour, to bound memory
+	maxKeysPerHour = 100000
+	// Queries are spread over shards by name so that they do not contend for one lock
+	shardCount = 16
+	// How long a report is reused, longer than the polling interval of the dashboard
+	reportTTL = 5 * time.Second
+)
+
+// bucket holds the statistics of an hour
+type bucket struct {
+	hour           int64 // hours since unix epoch
+	queries        int
+	blocked        int
+	blockReasons   map[string]int
+	domains        map[string]int
+	blockedDomains map[string]int
+	clients        map[string]int
+}
+
+func newBucket(hour int64) *bucket {
+	return &bucket{
+		hour:           hour,
+		blockReasons:   make(map[string]int),
+		domains:        make(map[string]int),
+		blockedDomains: make(map[string]int),
+		clients:        make(map[string]int),
+	}
+}
+
+func increase(m map[string]int, key string) {
+	if _, ok := m[key]; ok || len(m) < maxKeysPerHour/shardCount {
+		m[key]++
+	}
+}
+
+// shard is a ring of hourly buckets with its own lock
+type shard struct {
+	lock    sync.Mutex
+	buckets []*bucket
+}
+
+// Stats counts queries in shards of hourly buckets
+type Stats struct {
+	shards [shardCount]shard
+
+	reportLock sync.Mutex
+	report     *Report
+	reportN    int
+	reportTime time.Time
+}
+
+// New returns statistics over the last window hours
+func New(window int) *Stats {
+	if window <= 0 {
+		window = defaultWindow
+	}
+	s := new(Stats)
+	for i := range s.shards {
+		s.shards[i].buckets = make([]*bucket, window)
+	}
+	return s
+}
+
+// SetWindow changes the number of hours, statistics in the new window are kept
+func (s *Stats) SetWindow(window int) {
+	if window <= 0 {
+		window = defaultWindow
+	}
+	now := currentHour(time.Now())
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.lock.Lock()
+		if window != len(sh.buckets) {
+			buckets := make([]*bucket, window)
+			for _, b := range sh.buckets {
+				if b != nil && now-b.hour < int64(window) {
+					buckets[b.hour%int64(window)] = b
+				}
+			}
+			sh.buckets = buckets
+		}
+		sh.lock.Unlock()
+	}
+	s.reportLock.Lock()
+	s.report = nil
+	s.reportLock.Unlock()
+}
+
+func currentHour(t time.Time) int64 { return t.Unix() / 3600 }
+
+// shardOf picks the shard of name with FNV-1a
+func (s *Stats) shardOf(name string) *shard {
+	h := uint32(2166136261)
+	for i := 0; i < len(name); i++ {
+		h ^= uint32(name[i])
+		h *= 16777619
+	}
+	return &s.shards[h%shardCount]
+}
+
+// Record counts a query of name from client, blockReason is empty if the query is not blocked
+func (s *Stats) Record(t time.Time, client string, name string, blockReason string) {
+	hour := currentHour(t)
+	sh := s.shardOf(name)
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	i := hour % int64(len(sh.buckets))
+	b := sh.buckets[i]
+	if b == nil || b.hour != hour {
+		b = newBucket(hour)
+		sh.buckets[i] = b
+	}
+	b.queries++
+	increase(b.domains, name)
+	increase(b.clients, client)
+	if blockReason != "" {
+		b.blocked++
+		b.blockReasons[blockReason]++
+		increase(b.blockedDomains, name)
+	}
+}
+
+// Count is the number of queries of a domain or from a client
+type Count struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// HourCount is the number of queries in an hour
+type HourCount struct {
+	Time    time.Time `json:"time"`
+	Queries int       `json:"queries"`
+	Blocked int       `json:"blocked"`
+}
+
+// Report is the statistics over the window
+type Report struct {
+	WindowHours       int            `json:"window_hours"`
+	Queries           int            `json:"queries"`
+	Blocked           int            `json:"blocked"`
+	BlockReasons      map[string]int `json:"block_reasons"`
+	TopDomains        []Count        `json:"top_domains"`
+	TopBlockedDomains []Count        `json:"top_blocked_domains"`
+	TopClients        []Count        `json:"top_clients"`
+	Hourly            []HourCount    `json:"hourly"`
+}
+
+// Report returns top n domains, blocked domains and clients, and counts of every hour in the window
+// from the oldest one. The report is reused for reportTTL, callers must not modify it.
+func (s *Stats) Report(n int) *Report {
+	if n <= 0 {
+		n = defaultTopN
+	}
+	s.reportLock.Lock()
+	defer s.reportLock.Unlock()
+	if s.report != nil && s.reportN == n && time.Since(s.reportTime) < reportTTL {
+		return s.report
+	}
+	s.report, s.reportN, s.reportTime = s.merge(n), n, time.Now()
+	return s.report
+}
+
+func (s *Stats) merge(n int) *Report {
+	now := currentHour(time.Now())
+	r := &Report{BlockReasons: make(map[string]int)}
+	domains := make(map[string]int)
+	blockedDomains := make(map[string]int)
+	clients := make(map[string]int)
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.lock.Lock()
+		window := int64(len(sh.buckets))
+		if r.Hourly == nil {
+			r.WindowHours = int(window)
+			r.Hourly = make([]HourCount, window)
+			for j := range r.Hourly {
+				r.Hourly[j].Time = time.Unix((now-window+1+int64(j))*3600, 0)
+			}
+		}
+		for j := range r.Hourly {
+			// Shards may briefly disagree on the window while it is being changed
+			hour := now - int64(r.WindowHours) + 1 + int64(j)
+			if b := sh.buckets[hour%window]; b != nil && b.hour == hour {
+				r.Hourly[j].Queries += b.queries
+				r.Hourly[j].Blocked += b.blocked
+				r.Queries += b.queries
+				r.Blocked += b.blocked
+				merge(r.BlockReasons, b.blockReasons)
+				merge(domains, b.domains)
+				merge(blockedDomains, b.blockedDomains)
+				merge(clients, b.clients)
+			}
+		}
+		sh.lock.Unlock()
+	}
+	r.TopDomains = top(domains, n)
+	r.TopBlockedDomains = top(blockedDomains, n)
+	r.TopClients = top(clients, n)
+	return r
+}
+
+func merge(dst map[string]int, src map[string]int) {
+	for k, v := range src {
+		dst[k] += v
+	}
+}
+
+func top(m map[string]int, n int) []Count {
+	counts := make([]Count, 0, len(m))
+	for k, v := range m {
+		counts = append(counts, Count{Name: k, Count: v})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Name < counts[j].Name
+	})
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts
+}
+
+var defaultStats = New(defaultWindow)
+
+// Default returns the statistics fed by the inbound server
+func Default() *Stats { return defaultStats }
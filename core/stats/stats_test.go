@@ -0,0 +1,76 @@
+package stats
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestStatsReport(t *testing.T) {
+	s := New(3)
+	now := time.Now()
+	s.Record(now, "10.0.0.1", "a.com", "")
+	s.Record(now, "10.0.0.1", "a.com", "")
+	s.Record(now, "10.0.0.2", "b.com", "domain")
+	s.Record(now.Add(-time.Hour), "10.0.0.2", "b.com", "ip")
+	s.Record(now.Add(-time.Hour), "10.0.0.3", "c.com", "")
+	// Out of the window
+	s.Record(now.Add(-5*time.Hour), "10.0.0.4", "d.com", "")
+
+	r := s.Report(2)
+	if r.Queries != 5 || r.Blocked != 2 {
+		t.Fatalf("queries %d, blocked %d", r.Queries, r.Blocked)
+	}
+	if r.BlockReasons["domain"] != 1 || r.BlockReasons["ip"] != 1 {
+		t.Errorf("block reasons %v", r.BlockReasons)
+	}
+	if len(r.TopDomains) != 2 || r.TopDomains[0] != (Count{"a.com", 2}) || r.TopDomains[1] != (Count{"b.com", 2}) {
+		t.Errorf("top domains %v", r.TopDomains)
+	}
+	if len(r.TopBlockedDomains) != 1 || r.TopBlockedDomains[0] != (Count{"b.com", 2}) {
+		t.Errorf("top blocked domains %v", r.TopBlockedDomains)
+	}
+	if len(r.TopClients) != 2 || r.TopClients[0] != (Count{"10.0.0.1", 2}) || r.TopClients[1] != (Count{"10.0.0.2", 2}) {
+		t.Errorf("top clients %v", r.TopClients)
+	}
+	if len(r.Hourly) != 3 || r.Hourly[2].Queries != 3 || r.Hourly[1].Queries != 2 || r.Hourly[0].Queries != 0 {
+		t.Errorf("hourly %v", r.Hourly)
+	}
+}
+
+func TestStatsSetWindow(t *testing.T) {
+	s := New(24)
+	now := time.Now()
+	s.Record(now, "10.0.0.1", "a.com", "")
+	s.Record(now.Add(-10*time.Hour), "10.0.0.1", "b.com", "")
+
+	s.SetWindow(2)
+	r := s.Report(10)
+	if r.WindowHours != 2 || r.Queries != 1 || len(r.TopDomains) != 1 || r.TopDomains[0].Name != "a.com" {
+		t.Errorf("report %+v", r)
+	}
+}
+
+func TestStatsReportCache(t *testing.T) {
+	s := New(3)
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		s.Record(now, "10.0.0.1", fmt.Sprintf("%d.com", i), "")
+	}
+
+	r := s.Report(5)
+	if r.Queries != 100 || len(r.TopDomains) != 5 || r.TopClients[0] != (Count{"10.0.0.1", 100}) {
+		t.Fatalf("report %+v", r)
+	}
+	s.Record(now, "10.0.0.1", "a.com", "")
+	if s.Report(5) != r {
+		t.Error("report is not reused")
+	}
+	if r := s.Report(10); r.Queries != 101 {
+		t.Errorf("queries %d with another n", r.Queries)
+	}
+	s.SetWindow(2)
+	if r := s.Report(10); r.WindowHours != 2 {
+		t.Errorf("window %d after SetWindow", r.WindowHours)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2016 shawn1m. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package core
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/shawn1m/overture/core/subscription"
+)
+
+// A failed update is retried after this duration, or the interval of the subscription if it is shorter
+var subscriptionRetry = 5 * time.Minute
+
+// subscriber updates rule files subscribed in conf, and reloads the components using the changed ones
+type subscriber struct {
+	client        *subscription.Client
+	subscriptions []*subscription.Subscription
+
+	// Time to retry the failed subscriptions
+	retries map[*subscription.Subscription]time.Time
+
+	lock   sync.Mutex
+	stop   chan struct{}
+	closed bool
+}
+
+var (
+	subscriberLock    sync.Mutex
+	currentSubscriber *subscriber
+)
+
+// startSubscriptions starts updating subscriptions of conf, the previous subscriber is stopped
+func startSubscriptions() {
+	subscriberLock.Lock()
+	defer subscriberLock.Unlock()
+
+	if currentSubscriber != nil {
+		currentSubscriber.close()
+		currentSubscriber = nil
+	}
+	if len(conf.Subscriptions) == 0 {
+		return
+	}
+
+	s := &subscriber{
+		client:        conf.SubscriptionClient,
+		subscriptions: conf.Subscriptions,
+		retries:       map[*subscription.Subscription]time.Time{},
+		stop:          make(chan struct{}),
+	}
+	go s.run()
+	currentSubscriber = s
+	log.Infof("Updating %d subscriptions", len(s.subscriptions))
+}
+
+func stopSubscriptions() {
+	subscriberLock.Lock()
+	defer subscriberLock.Unlock()
+
+	if currentSubscriber != nil {
+		currentSubscriber.close()
+		currentSubscriber = nil
+	}
+}
+
+func (s *subscriber) run() {
+	for {
+		next := s.update()
+		select {
+		case <-time.After(time.Until(next)):
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// update updates the subscriptions which are due, and returns the time of the next update
+func (s *subscriber) update() time.Time {
+	var components []string
+	changed := map[string]bool{}
+	now := time.Now()
+	var next time.Time
+	setNext := func(t time.Time) {
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	for _, sub := range s.subscriptions {
+		due := sub.LastUpdate().Add(sub.Interval)
+		if t, ok := s.retries[sub]; ok {
+			due = t
+		}
+		if due.After(now) {
+			setNext(due)
+			continue
+		}
+
+		ok, err := s.client.Update(sub)
+		if err != nil {
+			retry := subscriptionRetry
+			if sub.Interval < retry {
+				retry = sub.Interval
+			}
+			log.Warnf("Failed to update %s, keep using the last copy: %s", sub.URL, err)
+			s.retries[sub] = now.Add(retry)
+			setNext(now.Add(retry))
+			continue
+		}
+		setNext(now.Add(sub.Interval))
+		delete(s.retries, sub)
+		if !ok {
+			log.Debugf("%s is not changed", sub.URL)
+			continue
+		}
+		log.Infof("%s is changed", sub.URL)
+		for _, c := range sub.Components {
+			if !changed[c] {
+				changed[c] = true
+				components = append(components, c)
+			}
+		}
+	}
+
+	for _, c := range components {
+		s.lock.Lock()
+		closed := s.closed
+		s.lock.Unlock()
+		if closed {
+			break
+		}
+		reloadComponent(c)
+	}
+	return next
+}
+
+func (s *subscriber) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		close(s.stop)
+	}
+}
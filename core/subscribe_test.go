@@ -0,0 +1,49 @@
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestSubscriptions(t *testing.T) {
+	var lock sync.Mutex
+	blockList := "blocked.com\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		w.Write([]byte(blockList))
+	}))
+	defer server.Close()
+	setBlockList := func(s string) {
+		lock.Lock()
+		blockList = s
+		lock.Unlock()
+	}
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.json")
+	writeTestConfig(t, file, fmt.Sprintf(`{
+  "BindAddress": ["127.0.0.1:0"],
+  "PrimaryDNS": [{"Name": "Primary", "Address": "127.0.0.1:53", "Protocol": "udp", "Timeout": 1}],
+  "OnlyPrimaryDNS": true,
+  "BlockFile": {"DomainFile": %q},
+  "Subscription": {"Interval": 1, "CacheDir": %q}
+}`, server.URL+"/block", filepath.Join(dir, "subscription")))
+	InitServer(file)
+	defer Stop()
+
+	// The list without a copy is downloaded in background after the server is started
+	isBlocked := func(domain string) func() bool {
+		return func() bool {
+			l := srv.Lists().BlockDomainList
+			return l != nil && l.Has(domain)
+		}
+	}
+	waitFor(t, "block domain list", isBlocked("blocked.com"))
+	setBlockList("blocked.com\nexample.com\n")
+	waitFor(t, "block domain list", isBlocked("example.com"))
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2016 shawn1m. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Package subscription downloads rule files published at URLs, and keeps the last good copy on disk,
+// so lists are loaded from the copy as from local files.
+package subscription
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Files larger than this are rejected
+const maxSize = 64 * 1024 * 1024
+
+// Subscription is a rule file at URL
+type Subscription struct {
+	URL string
+	// SHA-256 of the file in hex, or URL of a checksum file in the format of sha256sum. Not verified if empty.
+	Checksum string
+	// File keeping the last good copy
+	File string
+	// Time between two updates
+	Interval time.Duration
+	// Names of components loaded from File, used by the caller to reload them
+	Components []string
+}
+
+// IsURL returns true if a file in config is a URL to subscribe
+func IsURL(file string) bool {
+	return strings.HasPrefix(file, "http://") || strings.HasPrefix(file, "https://")
+}
+
+// CacheFile returns the file in dir keeping the last good copy of rawURL
+func CacheFile(dir string, rawURL string) string {
+	sum := sha256.Sum256([]byte(rawURL))
+	return filepath.Join(dir, hex.EncodeToString(sum[:8])+".txt")
+}
+
+// LastUpdate returns the time of the last successful update, it is zero if there is no copy
+func (s *Subscription) LastUpdate() time.Time {
+	info, err := os.Stat(s.File)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// Client downloads subscriptions
+type Client struct {
+	httpClient *http.Client
+}
+
+// NewClient returns a client connecting through the SOCKS5 proxy if socks5Address is not empty
+func NewClient(socks5Address string, timeout time.Duration) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if socks5Address != "" {
+		transport.Proxy = http.ProxyURL(&url.URL{Scheme: "socks5", Host: strings.TrimPrefix(socks5Address, "socks5://")})
+	}
+	return &Client{httpClient: &http.Client{Transport: transport, Timeout: timeout}}
+}
+
+func (c *Client) get(rawURL string) ([]byte, error) {
+	resp, err := c.httpClient.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxSize {
+		return nil, fmt.Errorf("file is larger than %d bytes", maxSize)
+	}
+	return b, nil
+}
+
+// verify checks content with the checksum of s
+func (c *Client) verify(s *Subscription, content []byte) error {
+	want := s.Checksum
+	if want == "" {
+		return nil
+	}
+	if IsURL(want) {
+		b, err := c.get(want)
+		if err != nil {
+			return fmt.Errorf("failed to download checksum: %s", err)
+		}
+		fields := strings.Fields(string(b))
+		if len(fields) == 0 {
+			return fmt.Errorf("checksum file is empty")
+		}
+		want = fields[0]
+	}
+	sum := sha256.Sum256(content)
+	if got := hex.EncodeToString(sum[:]); !strings.EqualFold(got, want) {
+		return fmt.Errorf("checksum mismatch, got %s, want %s", got, want)
+	}
+	return nil
+}
+
+// Update downloads s and replaces its copy if the content is verified. It returns true if the
+// content is changed. The copy is kept if anything fails.
+func (c *Client) Update(s *Subscription) (bool, error) {
+	content, err := c.get(s.URL)
+	if err != nil {
+		return false, err
+	}
+	if err := c.verify(s, content); err != nil {
+		return false, err
+	}
+
+	old, err := os.ReadFile(s.File)
+	if err == nil && bytes.Equal(old, content) {
+		// Record the time of update for LastUpdate
+		now := time.Now()
+		return false, os.Chtimes(s.File, now, now)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.File), 0755); err != nil {
+		return false, err
+	}
+	tmp := s.File + ".tmp"
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp, s.File); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,80 @@
+package subscription
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUpdate(t *testing.T) {
+	content := "example.com\n"
+	checksum := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/list":
+			w.Write([]byte(content))
+		case "/list.sha256":
+			w.Write([]byte(checksum + "  list\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	s := &Subscription{URL: server.URL + "/list", File: CacheFile(dir, server.URL+"/list")}
+	c := NewClient("", time.Second)
+	read := func() string {
+		b, _ := os.ReadFile(s.File)
+		return string(b)
+	}
+
+	if changed, err := c.Update(s); err != nil || !changed {
+		t.Fatalf("first update: changed %v, error %v", changed, err)
+	}
+	if read() != content {
+		t.Errorf("unexpected copy %q", read())
+	}
+	if changed, err := c.Update(s); err != nil || changed {
+		t.Errorf("update without changes: changed %v, error %v", changed, err)
+	}
+
+	content = "example.net\n"
+	sum := sha256.Sum256([]byte(content))
+	checksum = hex.EncodeToString(sum[:])
+	s.Checksum = server.URL + "/list.sha256"
+	if changed, err := c.Update(s); err != nil || !changed {
+		t.Fatalf("verified update: changed %v, error %v", changed, err)
+	}
+	if read() != content {
+		t.Errorf("unexpected copy %q", read())
+	}
+
+	content = "tampered.com\n"
+	if _, err := c.Update(s); err == nil {
+		t.Error("update should fail if checksum mismatches")
+	}
+	s.Checksum = ""
+	s.URL = server.URL + "/not-found"
+	if _, err := c.Update(s); err == nil {
+		t.Error("update should fail if status is not OK")
+	}
+	if read() != "example.net\n" {
+		t.Errorf("the last good copy should be kept, got %q", read())
+	}
+}
+
+func TestCacheFile(t *testing.T) {
+	a, b := CacheFile("dir", "http://a/list"), CacheFile("dir", "http://b/list")
+	if a == b || filepath.Dir(a) != "dir" {
+		t.Errorf("unexpected cache files %s and %s", a, b)
+	}
+	if !IsURL("https://a/list") || IsURL("./list") {
+		t.Error("unexpected result of IsURL")
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright (c) 2016 shawn1m. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package core
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// Changes of a file in this duration are reloaded once, files are usually written in several times
+var watchDebounce = 2 * time.Second
+
+// watcher reloads the affected component when the config file or a file referred by it is changed.
+// Directories of files are watched, so files replaced by renaming are also noticed.
+type watcher struct {
+	fsWatcher *fsnotify.Watcher
+	// Component of each file, with absolute path
+	files map[string]string
+
+	lock   sync.Mutex
+	timers map[string]*time.Timer
+	closed bool
+}
+
+var (
+	watcherLock    sync.Mutex
+	currentWatcher *watcher
+)
+
+// watchedFiles returns the component of every file in conf
+func watchedFiles() map[string]string {
+	files := map[string]string{}
+	// Copies of subscriptions are reloaded when they are updated
+	subscribed := map[string]bool{}
+	for _, s := range conf.Subscriptions {
+		subscribed[s.File] = true
+	}
+	add := func(file string, component string) {
+		if file == "" || subscribed[file] {
+			return
+		}
+		if abs, err := filepath.Abs(file); err == nil {
+			file = abs
+		}
+		// A file referred by several components reloads the config
+		if c, ok := files[file]; ok && c != component {
+			component = "config"
+		}
+		files[file] = component
+	}
+
+	add(conf.DomainFile.Primary, "rules")
+	add(conf.DomainFile.Alternative, "rules")
+	add(conf.IPNetworkFile.Primary, "rules")
+	add(conf.IPNetworkFile.Alternative, "rules")
+	for _, r := range conf.Rules {
+		add(r.DomainFile, "rules")
+		add(r.IPNetworkFile, "rules")
+	}
+	add(conf.DomainTTLFile, "domain-ttl")
+	add(conf.HostsFile.HostsFile, "hosts")
+	add(conf.BlockFile.DomainFile, "block-domain")
+	add(conf.BlockFile.IPFile, "block-ip")
+	add(conf.ReplaceFile.DomainFile, "replace-domain")
+	add(conf.ReplaceFile.IPFile, "replace-ip")
+	add(conf.FilePath, "config")
+	return files
+}
+
+// watchFiles starts watching files of conf if AutoReload is set, the previous watcher is stopped
+func watchFiles() {
+	watcherLock.Lock()
+	defer watcherLock.Unlock()
+
+	if currentWatcher != nil {
+		currentWatcher.close()
+		currentWatcher = nil
+	}
+	if !conf.AutoReload {
+		return
+	}
+
+	fsWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Errorf("Failed to watch files: %s", err)
+		return
+	}
+	w := &watcher{fsWatcher: fsWatcher, files: watchedFiles(), timers: map[string]*time.Timer{}}
+	dirs := map[string]bool{}
+	for file := range w.files {
+		dirs[filepath.Dir(file)] = true
+	}
+	for dir := range dirs {
+		if err := fsWatcher.Add(dir); err != nil {
+			log.Warnf("Failed to watch %s: %s", dir, err)
+		}
+	}
+	go w.run()
+	currentWatcher = w
+	log.Infof("Watching %d files for changes", len(w.files))
+}
+
+func stopWatching() {
+	watcherLock.Lock()
+	defer watcherLock.Unlock()
+
+	if currentWatcher != nil {
+		currentWatcher.close()
+		currentWatcher = nil
+	}
+}
+
+func (w *watcher) run() {
+	for {
+		select {
+		case event, ok := <-w.fsWatcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			if component, ok := w.files[filepath.Clean(event.Name)]; ok {
+				log.Debugf("File %s is changed: %s", event.Name, event.Op)
+				w.schedule(component)
+			}
+		case err, ok := <-w.fsWatcher.Errors:
+			if !ok {
+				return
+			}
+			log.Warnf("File watcher error: %s", err)
+		}
+	}
+}
+
+// schedule reloads component after changes stop for watchDebounce
+func (w *watcher) schedule(component string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.closed {
+		return
+	}
+	if t, ok := w.timers[component]; ok {
+		t.Reset(watchDebounce)
+		return
+	}
+	w.timers[component] = time.AfterFunc(watchDebounce, func() {
+		w.lock.Lock()
+		delete(w.timers, component)
+		closed := w.closed
+		w.lock.Unlock()
+		if !closed {
+			reloadComponent(component)
+		}
+	})
+}
+
+func (w *watcher) close() {
+	w.lock.Lock()
+	w.closed = true
+	for _, t := range w.timers {
+		t.Stop()
+	}
+	w.lock.Unlock()
+	w.fsWatcher.Close()
+}
+
+// reloadComponent loads files of component again and replaces it in the running server
+func reloadComponent(component string) {
+	if component == "config" {
+		Reload()
+		return
+	}
+
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	log.Infof("Reloading %s", component)
+	switch component {
+	case "rules":
+		adminLock.Lock()
+		conf.ReloadRules()
+		d := *srv.Dispatcher()
+		d.Rules = conf.Rules
+		srv.SetDispatcher(d)
+		adminLock.Unlock()
+	case "domain-ttl":
+		adminLock.Lock()
+		conf.ReloadDomainTTLMap()
+		d := *srv.Dispatcher()
+		d.DomainTTLMap = conf.DomainTTLMap
+		srv.SetDispatcher(d)
+		adminLock.Unlock()
+	default:
+		reloadRuleList(component)
+	}
+}
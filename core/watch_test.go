@@ -0,0 +1,74 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shawn1m/overture/core/config"
+)
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for i := 0; i < 50; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Errorf("timeout waiting for %s", what)
+}
+
+func TestWatchFiles(t *testing.T) {
+	watchDebounce = 100 * time.Millisecond
+	defer func() { watchDebounce = 2 * time.Second }()
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.json")
+	blockFile := filepath.Join(dir, "block_domain")
+	primaryFile := filepath.Join(dir, "primary_domain")
+	writeTestConfig(t, blockFile, "blocked.com\n")
+	writeTestConfig(t, primaryFile, "primary.com\n")
+	writeTestConfig(t, file, fmt.Sprintf(`{
+  "BindAddress": ["127.0.0.1:0"],
+  "PrimaryDNS": [{"Name": "Primary", "Address": "127.0.0.1:53", "Protocol": "udp", "Timeout": 1}],
+  "AlternativeDNS": [{"Name": "Alternative", "Address": "127.0.0.1:53", "Protocol": "udp", "Timeout": 1}],
+  "DomainFile": {"Primary": %q},
+  "BlockFile": {"DomainFile": %q},
+  "AutoReload": true
+}`, primaryFile, blockFile))
+	InitServer(file)
+	defer Stop()
+
+	getConf := func() *config.Config {
+		reloadLock.Lock()
+		defer reloadLock.Unlock()
+		return conf
+	}
+	oldConf := getConf()
+	writeTestConfig(t, blockFile, "blocked.com\nexample.com\n")
+	waitFor(t, "block domain list", func() bool { return srv.Lists().BlockDomainList.Has("example.com") })
+
+	// Replaced by renaming
+	writeTestConfig(t, primaryFile+".tmp", "primary.com\nexample.net\n")
+	os.Rename(primaryFile+".tmp", primaryFile)
+	waitFor(t, "rules", func() bool {
+		for _, r := range srv.Dispatcher().Rules {
+			if r.DomainList != nil && r.DomainList.Has("example.net") {
+				return true
+			}
+		}
+		return false
+	})
+	if getConf() != oldConf {
+		t.Error("config should not be reloaded for a rule file")
+	}
+
+	raw, _ := os.ReadFile(file)
+	writeTestConfig(t, file, string(raw[:len(raw)-2])+`, "RejectQType": [28]}`)
+	waitFor(t, "config", func() bool { return getConf() != oldConf })
+	if qtypes := srv.Lists().RejectQType; len(qtypes) != 1 || qtypes[0] != 28 {
+		t.Errorf("unexpected reject qtype %v", qtypes)
+	}
+}
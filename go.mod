@@ -1,10 +1,32 @@
 module github.com/shawn1m/overture
 
-go 1.12
+go 1.24
 
 require (
+	github.com/BurntSushi/toml v1.4.0
+	github.com/dnstap/golang-dnstap v0.4.0
+	github.com/fsnotify/fsnotify v1.7.0
 	github.com/miekg/dns v1.1.31
+	github.com/prometheus/client_golang v1.20.5
+	github.com/quic-go/quic-go v0.59.1
 	github.com/silenceper/pool v0.0.0-20200429081406-a659d818d9aa
 	github.com/sirupsen/logrus v1.6.0
-	golang.org/x/net v0.0.0-20200707034311-ab3426394381
+	golang.org/x/net v0.43.0
+	google.golang.org/protobuf v1.34.2
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/farsightsec/golang-framestream v0.3.0 // indirect
+	github.com/klauspost/compress v1.17.9 // indirect
+	github.com/konsorten/go-windows-terminal-sequences v1.0.3 // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+	github.com/prometheus/client_model v0.6.1 // indirect
+	github.com/prometheus/common v0.55.0 // indirect
+	github.com/prometheus/procfs v0.15.1 // indirect
+	golang.org/x/crypto v0.41.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
 )
@@ -0,0 +1,105 @@
+// Copyright (c) 2016 shawn1m. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/shawn1m/overture/core/config"
+)
+
+// Subcommands, which return the exit code
+var commands = map[string]func(args []string) int{
+	"config": configCommand,
+	"check":  checkCommand,
+}
+
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "convert" {
+		fmt.Fprintln(os.Stderr, "Usage: overture config convert [-from format] [-to format] input [output]")
+		return 2
+	}
+	return convertCommand(args[1:])
+}
+
+// convertCommand translates a config file between JSON, YAML and TOML
+func convertCommand(args []string) int {
+	fs := flag.NewFlagSet("config convert", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: overture config convert [-from format] [-to format] input [output]")
+		fmt.Fprintln(fs.Output(), "Formats are json, yaml and toml, decided by file extensions if not set. The result is written to stdout if output is not set.")
+		fs.PrintDefaults()
+	}
+	from := fs.String("from", "", "format of input")
+	to := fs.String("to", "", "format of output")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 || (fs.NArg() == 1 && *to == "") {
+		fs.Usage()
+		return 2
+	}
+
+	input := fs.Arg(0)
+	if *from == "" {
+		*from = config.FormatOf(input)
+	}
+	output := fs.Arg(1)
+	if *to == "" {
+		*to = config.FormatOf(output)
+	}
+
+	b, err := os.ReadFile(input)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	b, err = config.Convert(b, *from, *to)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to convert %s: %s\n", input, err)
+		return 1
+	}
+	if output == "" {
+		os.Stdout.Write(b)
+		return 0
+	}
+	if err := os.WriteFile(output, b, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// checkCommand validates a config file and files referred by it, the exit code is 1 if any problem is found
+func checkCommand(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: overture check [-c config] [-f format]")
+		fs.PrintDefaults()
+	}
+	configPath := fs.String("c", "./config.json", "config file path")
+	configFormat := fs.String("f", "", "config file format: json, yaml or toml, decided by file extension if not set")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+
+	config.SetFileFormat(*configFormat)
+	problems := config.Check(*configPath)
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%d problems found\n", len(problems))
+		return 1
+	}
+	fmt.Printf("%s is OK\n", *configPath)
+	return 0
+}
@@ -17,6 +17,7 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/shawn1m/overture/core"
+	"github.com/shawn1m/overture/core/config"
 )
 
 // For auto version building
@@ -25,6 +26,7 @@ var (
 	version string
 
 	configPath      = flag.String("c", "./config.json", "config file path")
+	configFormat    = flag.String("f", "", "config file format: json, yaml or toml, decided by file extension if not set")
 	logPath         = flag.String("l", "", "log file path")
 	isLogVerbose    = flag.Bool("v", false, "verbose mode")
 	processorNumber = flag.Int("p", runtime.NumCPU(), "number of processor to use")
@@ -32,6 +34,12 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:]))
+		}
+	}
+
 	flag.Parse()
 
 	if *isShowVersion {
@@ -66,8 +74,25 @@ func main() {
 
 	// Waiting for SIGTERM to close app. InitServer() always return.
 	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, syscall.SIGTERM)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	reopen := make(chan os.Signal, 1)
+	notifyReopen(reopen)
+	reload := make(chan os.Signal, 1)
+	notifyReload(reload)
 
+	config.SetFileFormat(*configFormat)
 	core.InitServer(*configPath)
-	<-stop
+	for {
+		select {
+		case <-reopen:
+			core.ReopenQueryLog()
+		case <-reload:
+			// Reopen even if the new config is invalid, logrotate sends SIGHUP after moving the file
+			core.ReopenQueryLog()
+			core.Reload()
+		case <-stop:
+			core.Stop()
+			return
+		}
+	}
 }
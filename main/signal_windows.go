@@ -0,0 +1,11 @@
+package main
+
+import (
+	"os"
+)
+
+// There is no signal to reopen query log file on windows
+func notifyReopen(c chan<- os.Signal) {}
+
+// There is no signal to reload config on windows
+func notifyReload(c chan<- os.Signal) {}